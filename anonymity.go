@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Anonymity levels, from least to most anonymous.
+const (
+	anonTransparent = "transparent"
+	anonAnonymous   = "anonymous"
+	anonElite       = "elite"
+)
+
+var anonRank = map[string]int{anonTransparent: 0, anonAnonymous: 1, anonElite: 2}
+
+// proxyHeaders are request headers forwarding proxies add that reveal a
+// proxy is in use, or whose value carries the client address.
+var proxyHeaders = []string{
+	"via",
+	"x-forwarded-for",
+	"forwarded",
+	"x-real-ip",
+	"client-ip",
+	"x-client-ip",
+	"x-proxy-id",
+	"proxy-connection",
+}
+
+var (
+	ipv4Regex = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// echoLineRegex matches a "Name: value" or, as PHP judges print their
+	// $_SERVER variables, "HTTP_NAME = value" line of a text echo.
+	echoLineRegex = regexp.MustCompile(`^\s*([A-Za-z0-9_-]+)\s*[:=]\s*(.*)$`)
+	htmlTagRegex  = regexp.MustCompile(`<[^>]*>`)
+)
+
+// parseJudgeEcho returns the fields of a judge's echo keyed by lower-case
+// header name: the "headers" object and "origin" of a JSON echo such as
+// httpbin's (or the top-level fields of a flat one), or the header lines of
+// a text one, with PHP's HTTP_ prefix and underscores undone. Anything else
+// in the body, such as page text around the echo, is ignored.
+func parseJudgeEcho(body []byte) map[string]string {
+	fields := make(map[string]string)
+	var js map[string]any
+	if json.Unmarshal(body, &js) == nil {
+		if headers, ok := js["headers"].(map[string]any); ok {
+			if origin, ok := js["origin"]; ok {
+				fields["origin"] = fmt.Sprint(origin)
+			}
+			js = headers
+		}
+		for name, value := range js {
+			fields[strings.ToLower(name)] = fmt.Sprint(value)
+		}
+		return fields
+	}
+	for _, line := range strings.Split(htmlTagRegex.ReplaceAllString(string(body), "\n"), "\n") {
+		m := echoLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		name := strings.ReplaceAll(strings.ToLower(m[1]), "_", "-")
+		name = strings.TrimPrefix(name, "http-")
+		fields[name] = strings.TrimSpace(m[2])
+	}
+	return fields
+}
+
+// echoedIPs returns the IPv4 addresses in the echoed fields' values, except
+// the Host header, which carries the judge's own address.
+func echoedIPs(fields map[string]string) []string {
+	var ips []string
+	for name, value := range fields {
+		if name != "host" {
+			ips = append(ips, ipv4Regex.FindAllString(value, -1)...)
+		}
+	}
+	return ips
+}
+
+// anonymityCheck classifies HTTP proxies by what a judge, an endpoint
+// echoing the request it received (headers and, ideally, client address),
+// learns about the client through them.
+type anonymityCheck struct {
+	req *probeRequest
+	// realIPs are the addresses the judge reports for a direct request.
+	realIPs []string
+	// min is the least anonymous level kept; "" keeps every level.
+	min string
+}
+
+// newAnonymityCheck requests judge directly to learn which addresses it
+// sees for this host; a proxy that lets any of them through is transparent.
+// With -via-socks, dial is the gateway's, so the addresses are the ones
+// proxies see connections come from; nil dials directly.
+func newAnonymityCheck(judge, min string, timeout time.Duration, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*anonymityCheck, error) {
+	req, err := parseProbeRequest("GET " + judge)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: timeout}
+	if dial != nil {
+		client.Transport = &http.Transport{DialContext: dial}
+	}
+	resp, err := client.Get(req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("judge: " + resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	ips := echoedIPs(parseJudgeEcho(body))
+	if len(ips) == 0 {
+		return nil, errors.New("judge response doesn't contain this host's address")
+	}
+	return &anonymityCheck{req: req, realIPs: ips, min: min}, nil
+}
+
+// level classifies the judge's echo of a request made through a proxy.
+func (a *anonymityCheck) level(body []byte) string {
+	fields := parseJudgeEcho(body)
+	for _, ip := range echoedIPs(fields) {
+		for _, real := range a.realIPs {
+			if ip == real {
+				return anonTransparent
+			}
+		}
+	}
+	for _, h := range proxyHeaders {
+		if _, ok := fields[h]; ok {
+			return anonAnonymous
+		}
+	}
+	return anonElite
+}
+
+// keep reports whether level passes the -anonymity filter.
+func (a *anonymityCheck) keep(level string) bool {
+	return a.min == "" || anonRank[level] >= anonRank[a.min]
+}
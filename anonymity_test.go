@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAnonymityLevel(t *testing.T) {
+	a := &anonymityCheck{realIPs: []string{"203.0.113.7"}}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"httpbin elite", `{"args": {}, "headers": {"Host": "httpbin.org", "User-Agent": "x"}, "origin": "198.51.100.1", "url": "http://httpbin.org/get"}`, anonElite},
+		{"httpbin anonymous", `{"headers": {"Host": "httpbin.org", "Via": "1.1 squid"}, "origin": "198.51.100.1"}`, anonAnonymous},
+		{"httpbin transparent in header", `{"headers": {"X-Forwarded-For": "203.0.113.7"}, "origin": "198.51.100.1"}`, anonTransparent},
+		{"httpbin transparent in origin", `{"headers": {"Host": "httpbin.org"}, "origin": "203.0.113.7, 198.51.100.1"}`, anonTransparent},
+		{"flat json", `{"via": "1.0 proxy", "remote_addr": "198.51.100.1"}`, anonAnonymous},
+		{"php echo", "<pre>\nREMOTE_ADDR = 198.51.100.1\nHTTP_X_FORWARDED_FOR = 203.0.113.7\n</pre>", anonTransparent},
+		{"php echo anonymous", "<pre>\nREMOTE_ADDR = 198.51.100.1\nHTTP_VIA = 1.1 proxy\n</pre>", anonAnonymous},
+		// Page text around a text echo doesn't count as headers.
+		{"page text", "<p>Find out what your browser sends via this page</p>\nUser-Agent: x\nHost: judge.example", anonElite},
+		{"prefix of a real address", `{"headers": {"X-Request-Id": "203.0.113.70"}}`, anonElite},
+		{"host header", `{"headers": {"Host": "203.0.113.7"}}`, anonElite},
+	}
+	for _, tt := range tests {
+		if got := a.level([]byte(tt.body)); got != tt.want {
+			t.Errorf("%s: level = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
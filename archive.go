@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// eachEntry calls fn with every candidate list contained in r. Plain input
+// is a single list. Gzip input (detected by its magic bytes) is
+// decompressed, and if it holds a tar archive, as in .tar.gz dumps, fn is
+// called once per regular file entry.
+func eachEntry(r io.Reader, fn func(io.Reader) error) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+	if magic, _ := br.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return fn(br)
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	gbr := bufio.NewReaderSize(gz, 256*1024)
+	// A tar header carries "ustar" at offset 257.
+	if head, _ := gbr.Peek(262); len(head) < 262 || string(head[257:262]) != "ustar" {
+		return fn(gbr)
+	}
+	tr := tar.NewReader(gbr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(tr); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeContent undoes a response's Content-Encoding. Sources are fetched
+// with an explicit Accept-Encoding, so the transport leaves bodies as they
+// arrived. Deflate is accepted both zlib-wrapped, as the spec says, and raw,
+// as some servers send it. Unknown encodings are an error.
+func decodeContent(body io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		br := bufio.NewReader(body)
+		// A zlib header's first byte names the deflate method (8) in its low
+		// nibble, and the two header bytes are a multiple of 31.
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"os"
+	"testing"
+)
+
+const fixtureList = "# fixture for decodeContent\n1.2.3.4:8080\n5.6.7.8:3128\n[2001:db8::1]:1080\n"
+
+func TestDecodeContent(t *testing.T) {
+	gzipped, err := os.ReadFile("testdata/list.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zl, raw bytes.Buffer
+	zw := zlib.NewWriter(&zl)
+	zw.Write([]byte(fixtureList))
+	zw.Close()
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write([]byte(fixtureList))
+	fw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", []byte(fixtureList)},
+		{"identity", []byte(fixtureList)},
+		{"gzip", gzipped},
+		{"x-gzip", gzipped},
+		{" GZIP ", gzipped},
+		{"deflate", zl.Bytes()},
+		{"deflate", raw.Bytes()},
+	}
+	for _, tt := range tests {
+		r, err := decodeContent(bytes.NewReader(tt.body), tt.encoding)
+		if err != nil {
+			t.Errorf("decodeContent(%q): %v", tt.encoding, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != fixtureList {
+			t.Errorf("decodeContent(%q) read %q, %v, want the fixture list", tt.encoding, got, err)
+		}
+	}
+
+	if got := extractProxies(fixtureList, nil); len(got) != 3 {
+		t.Errorf("fixture list has %d candidates, want 3", len(got))
+	}
+	if _, err := decodeContent(bytes.NewReader(gzipped), "br"); err == nil {
+		t.Error("decodeContent accepted br")
+	}
+	if _, err := decodeContent(bytes.NewReader([]byte(fixtureList)), "gzip"); err == nil {
+		t.Error("decodeContent(gzip) accepted a plain body")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// asnRange is one address range from the ASN database.
+type asnRange struct {
+	start, end netip.Addr
+	asn        uint32
+	org        string
+}
+
+// asnDB maps addresses to the autonomous system announcing them. It reads
+// the iptoasn.com TSV layout (range start, range end, AS number, country,
+// description), optionally gzipped; ranges with AS number 0 are unrouted
+// and skipped.
+type asnDB struct {
+	ranges []asnRange // sorted by start
+}
+
+func loadASNDB(path string) (*asnDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &asnDB{}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("%s:%d: malformed range", path, line)
+		}
+		if asn == 0 {
+			continue
+		}
+		db.ranges = append(db.ranges, asnRange{
+			start: start.Unmap(),
+			end:   end.Unmap(),
+			asn:   uint32(asn),
+			org:   fields[4],
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	return db, nil
+}
+
+// lookup finds the range containing the host of proxy (host:port).
+func (db *asnDB) lookup(proxy string) (asnRange, bool) {
+	host, _, err := net.SplitHostPort(proxy)
+	if err != nil {
+		host = proxy
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return asnRange{}, false
+	}
+	ip = ip.Unmap()
+	i := sort.Search(len(db.ranges), func(i int) bool { return ip.Less(db.ranges[i].start) })
+	if i == 0 {
+		return asnRange{}, false
+	}
+	rg := db.ranges[i-1]
+	if rg.start.BitLen() != ip.BitLen() || rg.end.Less(ip) {
+		return asnRange{}, false
+	}
+	return rg, true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// dialCounters tracks validation dials so -auto-tune can spot local
+// resource exhaustion.
+type dialCounters struct {
+	attempts uint64
+	failures uint64
+	// local counts failures caused by this machine running out of sockets,
+	// ports or buffers rather than by the proxy.
+	local uint64
+}
+
+func (d *dialCounters) record(err error) {
+	atomic.AddUint64(&d.attempts, 1)
+	if err == nil {
+		return
+	}
+	atomic.AddUint64(&d.failures, 1)
+	if isLocalExhaustion(err) {
+		atomic.AddUint64(&d.local, 1)
+	}
+}
+
+func isLocalExhaustion(err error) bool {
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.ENOBUFS)
+}
+
+// concurrencyLimit is a semaphore whose size can change while workers are
+// waiting on it.
+type concurrencyLimit struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func newConcurrencyLimit(n int) *concurrencyLimit {
+	l := &concurrencyLimit{limit: n}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *concurrencyLimit) acquire() {
+	l.mu.Lock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+	l.mu.Unlock()
+}
+
+func (l *concurrencyLimit) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+func (l *concurrencyLimit) set(n int) {
+	l.mu.Lock()
+	l.limit = n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// autoTune adjusts lim between a floor and max once per interval. Any local
+// exhaustion error, or a dial failure rate jumping well above its running
+// baseline, halves the limit; otherwise it ramps back up by 10% of max.
+func autoTune(ctx context.Context, lim *concurrencyLimit, dc *dialCounters, max int, interval time.Duration) {
+	floor := max / 20
+	if floor < 1 {
+		floor = 1
+	}
+	cur := max
+	baseline := -1.0
+
+	var lastAttempts, lastFailures, lastLocal uint64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			lim.set(max)
+			return
+		}
+
+		attempts := atomic.LoadUint64(&dc.attempts)
+		failures := atomic.LoadUint64(&dc.failures)
+		local := atomic.LoadUint64(&dc.local)
+		da, df, dl := attempts-lastAttempts, failures-lastFailures, local-lastLocal
+		lastAttempts, lastFailures, lastLocal = attempts, failures, local
+		if da < 20 {
+			continue
+		}
+
+		rate := float64(df) / float64(da)
+		spike := baseline >= 0 && rate > baseline+0.2
+		next := cur
+		switch {
+		case dl > 0 || spike:
+			next = cur / 2
+			if next < floor {
+				next = floor
+			}
+		default:
+			next = cur + max/10
+			if next > max {
+				next = max
+			}
+			// Only learn the baseline from healthy intervals.
+			if baseline < 0 {
+				baseline = rate
+			} else {
+				baseline = 0.8*baseline + 0.2*rate
+			}
+		}
+		if next < cur {
+			slog.Warn("auto-tune reducing workers", "dial_failure_pct", math.Round(100*rate), "local_failures", dl, "workers", cur, "reduced_to", next)
+		}
+		if next != cur {
+			cur = next
+			lim.set(cur)
+		}
+	}
+}
+
+// errDialBudget is returned by dials refused because -max-connections was
+// reached.
+var errDialBudget = errors.New("connection attempt cap reached")
+
+// dialBudget caps the outbound connection attempts of a run. A nil budget
+// is unlimited.
+type dialBudget struct {
+	max       int64
+	used      int64
+	once      sync.Once
+	onExhaust func()
+}
+
+// take claims one connection attempt, reporting false once the cap is
+// reached. The first refusal calls onExhaust.
+func (b *dialBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	if atomic.AddInt64(&b.used, 1) <= b.max {
+		return true
+	}
+	b.once.Do(func() {
+		if b.onExhaust != nil {
+			b.onExhaust()
+		}
+	})
+	return false
+}
+
+// exhausted reports whether any attempt was refused.
+func (b *dialBudget) exhausted() bool {
+	return b != nil && atomic.LoadInt64(&b.used) > b.max
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// candidateSet is the dedup stage's record of the addresses already passed
+// on to validation.
+type candidateSet interface {
+	// add records addr and reports whether it was not seen before.
+	add(addr string) bool
+}
+
+// exactSet remembers every address. It is the default: no candidate is
+// ever dropped by mistake, at the cost of memory for each address.
+type exactSet struct {
+	m sync.Map
+}
+
+func (s *exactSet) add(addr string) bool {
+	_, loaded := s.m.LoadOrStore(addr, struct{}{})
+	return !loaded
+}
+
+// bloomSet is a bloom filter sized for an expected number of addresses at
+// a target false-positive rate (-bloom, -bloom-fp). Its memory is fixed up
+// front, but a false positive makes add report a new address as seen, and
+// that candidate is skipped. Once more addresses than planned for are
+// added, the false-positive rate climbs above the target.
+type bloomSet struct {
+	mu      sync.Mutex
+	bits    []uint64
+	m       uint64 // number of bits
+	k       int    // bits set per address
+	n       int    // addresses added
+	planned int
+}
+
+// newBloomSet sizes a filter for n addresses at false-positive rate p,
+// using the usual m = -n ln p / (ln 2)^2 bits and k = m/n ln 2 hashes.
+func newBloomSet(n int, p float64) *bloomSet {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomSet{bits: make([]uint64, (m+63)/64), m: m, k: k, planned: n}
+}
+
+func (b *bloomSet) add(addr string) bool {
+	// Two hashes combined as h1 + i*h2 (Kirsch and Mitzenmacher) stand in
+	// for k independent ones.
+	f1 := fnv.New64a()
+	f1.Write([]byte(addr))
+	f2 := fnv.New64()
+	f2.Write([]byte(addr))
+	h1, h2 := f1.Sum64(), f2.Sum64()|1
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	added := false
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			b.bits[word] |= mask
+			added = true
+		}
+	}
+	if added {
+		b.n++
+	}
+	return added
+}
+
+// bytes returns the size of the filter's bit array.
+func (b *bloomSet) bytes() int {
+	return len(b.bits) * 8
+}
+
+// overCapacity reports whether more addresses were added than the filter
+// was sized for.
+func (b *bloomSet) overCapacity() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n > b.planned
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigCheck(t *testing.T) {
+	// base is a valid configuration the cases below change one thing of.
+	base := func() *config {
+		return &config{
+			dedupWorkers: 1,
+			testHost:     "example.com",
+			quorum:       1,
+			labels:       "connect",
+			format:       "text",
+			mergeMode:    "first",
+			sortBy:       "ip",
+		}
+	}
+	if err := base().check(); err != nil {
+		t.Fatalf("check() on the base config: %v", err)
+	}
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   string // a substring of the error
+	}{
+		{"quorum above the hosts", func(c *config) { c.testHost, c.quorum = "a, b,", 3 }, "-quorum must be between 1 and the number of test hosts (2)"},
+		{"no test host", func(c *config) { c.testHost = " , " }, "-test-host needs at least one host"},
+		{"stream append filter", func(c *config) { c.streamOut, c.appendOut, c.requireFull = true, true, true }, "-stream -append cannot"},
+		{"revalidate with a filter", func(c *config) { c.revalidate, c.countries = "list.txt", "US" }, "-revalidate cannot be combined with -country"},
+		{"no-validate with tiers", func(c *config) { c.noValidate, c.outSlow = true, "slow.txt" }, "-out-fast and -out-slow"},
+		{"insecure without https", func(c *config) { c.insecure = true }, "-insecure requires -mode https"},
+		{"worker without coordinator", func(c *config) { c.role = "worker" }, "worker requires -coordinator"},
+		{"open coordinator", func(c *config) { c.role, c.listenAddr = "coordinator", ":8700" }, "requires -dist-token"},
+		{"bad anonymity", func(c *config) { c.anonymity = "stealth" }, "invalid -anonymity: stealth"},
+		{"monitor with a connection cap", func(c *config) { c.monitorFile, c.maxConns = "list.txt", 5 }, "-max-connections cannot be combined with -monitor"},
+	}
+	for _, tt := range tests {
+		c := base()
+		tt.change(c)
+		err := c.check()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: check() = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+	c := base()
+	c.insecure, c.mode = true, " HTTPS"
+	if err := c.check(); err != nil {
+		t.Errorf("-insecure with -mode https: %v", err)
+	}
+}
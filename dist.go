@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Distributed validation splits the pipeline across machines. The
+// coordinator runs fetching and dedup as usual but, instead of validating
+// locally, hands candidates out over HTTP; workers lease batches, validate
+// them from their own network location and post the valid results back.
+//
+//	GET  /lease?n=N   -> leaseResponse
+//	POST /results     <- reportRequest
+//
+// A lease not reported within the lease timeout is handed out again. Lease
+// IDs are random, so only the worker holding a lease can report it, and
+// results for a lease that expired or was already reported are refused.
+// A report only delivers results for the lease's own candidates.
+
+const (
+	// maxLeaseSize caps how many candidates one lease request can take.
+	maxLeaseSize = 1000
+	// leaseWait is how long a lease request waits for the first candidate.
+	leaseWait = time.Second
+	// maxReportBytes caps the body of a results report, ample for a full
+	// lease of valid results.
+	maxReportBytes = 16 << 20
+)
+
+type leaseResponse struct {
+	Lease      string      `json:"lease"`
+	Candidates []candidate `json:"candidates"`
+	// Done tells the worker that every candidate has been validated.
+	Done bool `json:"done"`
+}
+
+type reportRequest struct {
+	Lease   string   `json:"lease"`
+	Results []result `json:"results"`
+}
+
+type lease struct {
+	cands    []candidate
+	deadline time.Time
+}
+
+// coordinator hands candidates from jobs to remote workers and passes their
+// results to deliver. checked is called for every candidate of a reported
+// lease.
+type coordinator struct {
+	jobs         <-chan candidate
+	deliver      func(result) bool
+	checked      func(candidate)
+	token        string
+	leaseTimeout time.Duration
+
+	mu      sync.Mutex
+	leases  map[string]*lease
+	requeue []candidate
+	drained bool // jobs is closed and empty
+	once    sync.Once
+	done    chan struct{}
+}
+
+// serveCoordinator serves the coordinator protocol on addr until every
+// candidate from jobs has been reported or ctx ends.
+func serveCoordinator(ctx context.Context, addr, token string, leaseTimeout time.Duration, jobs <-chan candidate, deliver func(result) bool, checked func(candidate)) error {
+	c := &coordinator{
+		jobs:         jobs,
+		deliver:      deliver,
+		checked:      checked,
+		token:        token,
+		leaseTimeout: leaseTimeout,
+		leases:       make(map[string]*lease),
+		done:         make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lease", c.handleLease)
+	mux.HandleFunc("/results", c.handleResults)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("coordinator listening", "addr", addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-c.done:
+		// Give idle workers polling for a lease a moment to hear about Done.
+		sleepCtx(ctx, 3*time.Second)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// errLeaseGone is returned to a worker whose lease expired, or was already
+// reported, before its results arrived.
+var errLeaseGone = errors.New("coordinator: lease expired or already reported")
+
+// loopbackAddr reports whether the listen address addr only accepts
+// connections from this machine.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newLeaseID returns an unguessable lease ID.
+func newLeaseID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (c *coordinator) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if c.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (c *coordinator) handleLease(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(w, r) {
+		return
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 100
+	}
+	if n > maxLeaseSize {
+		n = maxLeaseSize
+	}
+
+	c.mu.Lock()
+	c.expireLocked()
+	cands := c.takeRequeueLocked(n)
+	drained := c.drained
+	c.mu.Unlock()
+
+	if len(cands) < n && !drained {
+		var ok bool
+		cands, ok = c.takeJobs(cands, n)
+		if !ok {
+			c.mu.Lock()
+			c.drained = true
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	resp := leaseResponse{Candidates: cands}
+	if len(cands) > 0 {
+		resp.Lease = newLeaseID()
+		c.leases[resp.Lease] = &lease{cands: cands, deadline: time.Now().Add(c.leaseTimeout)}
+	} else {
+		resp.Done = c.finishedLocked()
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// takeJobs appends up to n candidates from jobs to cands, waiting briefly
+// for the first one. It reports false once jobs is closed.
+func (c *coordinator) takeJobs(cands []candidate, n int) ([]candidate, bool) {
+	timer := time.NewTimer(leaseWait)
+	defer timer.Stop()
+	for len(cands) < n {
+		if len(cands) == 0 {
+			select {
+			case cand, ok := <-c.jobs:
+				if !ok {
+					return cands, false
+				}
+				cands = append(cands, cand)
+			case <-timer.C:
+				return cands, true
+			}
+			continue
+		}
+		select {
+		case cand, ok := <-c.jobs:
+			if !ok {
+				return cands, false
+			}
+			cands = append(cands, cand)
+		default:
+			return cands, true
+		}
+	}
+	return cands, true
+}
+
+func (c *coordinator) handleResults(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req reportRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReportBytes)).Decode(&req); err != nil {
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	c.mu.Lock()
+	// An overdue lease's candidates have been, or are about to be, handed
+	// out again, so its results would be delivered twice.
+	c.expireLocked()
+	l := c.leases[req.Lease]
+	delete(c.leases, req.Lease)
+	c.mu.Unlock()
+	if l == nil {
+		http.Error(w, errLeaseGone.Error(), http.StatusConflict)
+		return
+	}
+	leased := make(map[string]bool, len(l.cands))
+	for _, cand := range l.cands {
+		leased[cand.Addr] = true
+		c.checked(cand)
+	}
+
+	// Only results for the lease's own candidates count, each once; a
+	// worker can't inject proxies it was never handed.
+	for _, res := range req.Results {
+		if !leased[res.Proxy] {
+			continue
+		}
+		delete(leased, res.Proxy)
+		if !c.deliver(res) {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.finishedLocked()
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireLocked requeues the candidates of overdue leases.
+func (c *coordinator) expireLocked() {
+	now := time.Now()
+	for id, l := range c.leases {
+		if now.After(l.deadline) {
+			c.requeue = append(c.requeue, l.cands...)
+			delete(c.leases, id)
+		}
+	}
+}
+
+func (c *coordinator) takeRequeueLocked(n int) []candidate {
+	if n > len(c.requeue) {
+		n = len(c.requeue)
+	}
+	cands := append([]candidate(nil), c.requeue[:n]...)
+	c.requeue = c.requeue[n:]
+	return cands
+}
+
+// finishedLocked reports whether all work is done, signalling serve once
+// it is.
+func (c *coordinator) finishedLocked() bool {
+	if !c.drained || len(c.leases) > 0 || len(c.requeue) > 0 {
+		return false
+	}
+	c.once.Do(func() { close(c.done) })
+	return true
+}
+
+// distWorker validates leased candidates for a coordinator.
+type distWorker struct {
+	base    string
+	token   string
+	workers int
+	client  *http.Client
+}
+
+// runDistWorker leases candidates from the coordinator at base until it
+// reports that all work is done, validating each batch with check on up to
+// workers goroutines. It returns how many candidates were checked and how
+// many were valid.
+func runDistWorker(ctx context.Context, base, token string, workers int, check func(candidate) (result, bool)) (checked, valid int) {
+	dw := &distWorker{base: base, token: token, workers: workers, client: &http.Client{Timeout: 30 * time.Second}}
+	for ctx.Err() == nil {
+		resp, err := dw.lease(ctx, 2*workers)
+		if err != nil {
+			slog.Warn("lease failed", "coordinator", base, "error", err)
+			sleepCtx(ctx, 2*time.Second)
+			continue
+		}
+		if resp.Done {
+			return checked, valid
+		}
+		if len(resp.Candidates) == 0 {
+			sleepCtx(ctx, time.Second)
+			continue
+		}
+
+		results := dw.validate(ctx, resp.Candidates, check)
+		if ctx.Err() != nil {
+			// Unreported candidates are handed out again when the lease
+			// expires.
+			return checked, valid
+		}
+		for ctx.Err() == nil {
+			err := dw.report(ctx, reportRequest{Lease: resp.Lease, Results: results})
+			if err == nil {
+				checked += len(resp.Candidates)
+				valid += len(results)
+				break
+			}
+			if errors.Is(err, errLeaseGone) {
+				// Another worker is validating the batch again.
+				slog.Warn("lease expired before its results were reported; raise -lease-timeout if this repeats", "lease", resp.Lease, "candidates", len(resp.Candidates))
+				break
+			}
+			slog.Warn("reporting results failed", "lease", resp.Lease, "error", err)
+			sleepCtx(ctx, 2*time.Second)
+		}
+	}
+	return checked, valid
+}
+
+func (dw *distWorker) validate(ctx context.Context, cands []candidate, check func(candidate) (result, bool)) []result {
+	var (
+		mu      sync.Mutex
+		results []result
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, dw.workers)
+	for _, cand := range cands {
+		cand := cand
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if r, ok := check(cand); ok {
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (dw *distWorker) lease(ctx context.Context, n int) (leaseResponse, error) {
+	var resp leaseResponse
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dw.base+"/lease?n="+strconv.Itoa(n), nil)
+	if err != nil {
+		return resp, err
+	}
+	res, err := dw.do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+	err = json.NewDecoder(res.Body).Decode(&resp)
+	return resp, err
+}
+
+func (dw *distWorker) report(ctx context.Context, rr reportRequest) error {
+	b, err := json.Marshal(rr)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dw.base+"/results", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := dw.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (dw *distWorker) do(req *http.Request) (*http.Response, error) {
+	if dw.token != "" {
+		req.Header.Set("Authorization", "Bearer "+dw.token)
+	}
+	res, err := dw.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusConflict {
+		res.Body.Close()
+		return nil, errLeaseGone
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, errors.New("coordinator: " + res.Status)
+	}
+	return res, nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8700": true,
+		"127.0.0.2:8700": true,
+		"[::1]:8700":     true,
+		"localhost:8700": true,
+		":8700":          false,
+		"0.0.0.0:8700":   false,
+		"10.0.0.5:8700":  false,
+		"8700":           false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestCoordinatorResults(t *testing.T) {
+	jobs := make(chan candidate, 4)
+	jobs <- candidate{Addr: "1.2.3.4:80", Source: "a"}
+	jobs <- candidate{Addr: "5.6.7.8:80", Source: "a"}
+	close(jobs)
+	var delivered []result
+	checked := 0
+	c := &coordinator{
+		jobs:         jobs,
+		deliver:      func(r result) bool { delivered = append(delivered, r); return true },
+		checked:      func(candidate) { checked++ },
+		token:        "s3cret",
+		leaseTimeout: time.Minute,
+		leases:       make(map[string]*lease),
+		done:         make(chan struct{}),
+	}
+
+	do := func(h http.HandlerFunc, method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	// Besides the leased candidate, each report repeats it and adds one
+	// the lease never held; only the first should be delivered.
+	report := func(lease string) string {
+		b, _ := json.Marshal(reportRequest{Lease: lease, Results: []result{{Proxy: "1.2.3.4:80"}, {Proxy: "1.2.3.4:80"}, {Proxy: "9.9.9.9:80"}}})
+		return string(b)
+	}
+
+	if w := do(c.handleLease, http.MethodGet, "/lease?n=1", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("lease with a wrong token: %d, want 401", w.Code)
+	}
+	var first, second leaseResponse
+	if err := json.NewDecoder(do(c.handleLease, http.MethodGet, "/lease?n=1", "s3cret", "").Body).Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(do(c.handleLease, http.MethodGet, "/lease?n=1", "s3cret", "").Body).Decode(&second); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Candidates) != 1 || len(second.Candidates) != 1 || first.Lease == second.Lease {
+		t.Fatalf("leases %+v and %+v, want one candidate each under distinct IDs", first, second)
+	}
+
+	if w := do(c.handleResults, http.MethodPost, "/results", "s3cret", report("1")); w.Code != http.StatusConflict {
+		t.Errorf("results for an unknown lease: %d, want 409", w.Code)
+	}
+	if w := do(c.handleResults, http.MethodPost, "/results", "s3cret", report(first.Lease)); w.Code != http.StatusNoContent {
+		t.Errorf("results for a live lease: %d, want 204", w.Code)
+	}
+	if w := do(c.handleResults, http.MethodPost, "/results", "s3cret", report(first.Lease)); w.Code != http.StatusConflict {
+		t.Errorf("results reported twice: %d, want 409", w.Code)
+	}
+
+	c.mu.Lock()
+	c.leases[second.Lease].deadline = time.Now().Add(-time.Second)
+	c.mu.Unlock()
+	if w := do(c.handleResults, http.MethodPost, "/results", "s3cret", report(second.Lease)); w.Code != http.StatusConflict {
+		t.Errorf("results for an expired lease: %d, want 409", w.Code)
+	}
+	c.mu.Lock()
+	requeued := len(c.requeue)
+	c.mu.Unlock()
+	if requeued != 1 {
+		t.Errorf("%d candidates requeued after expiry, want 1", requeued)
+	}
+
+	if len(delivered) != 1 || checked != 1 {
+		t.Errorf("delivered %d results and checked %d candidates, want 1 and 1", len(delivered), checked)
+	}
+
+	big := `{"lease":"x","results":[` + strings.Repeat(`{"Proxy":"1.2.3.4:80"},`, maxReportBytes/20) + `]}`
+	if w := do(c.handleResults, http.MethodPost, "/results", "s3cret", big); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized report: %d, want 413", w.Code)
+	}
+}
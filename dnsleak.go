@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dnsLeakPoll bounds how long the authority's log is polled for a lookup
+// after each test request.
+const dnsLeakPoll = 3 * time.Second
+
+// dnsLeakCheck detects proxies whose DNS lookups are performed by the
+// client's own resolvers. Each test makes the proxy resolve a unique name
+// under zone, a wildcard zone served by an authoritative server the user
+// controls, then asks that server's log (api) which resolvers queried the
+// name.
+type dnsLeakCheck struct {
+	zone   string
+	api    string
+	client *http.Client
+	local  map[string]bool
+
+	dialTimeout time.Duration
+	rwTimeout   time.Duration
+}
+
+// newDNSLeakCheck records which resolvers perform lookups for this host,
+// by resolving a unique name locally and reading it back from the log.
+func newDNSLeakCheck(zone, api string, dialTimeout, rwTimeout time.Duration) (*dnsLeakCheck, error) {
+	if !strings.Contains(api, "{name}") {
+		return nil, errors.New("-dns-leak-api must contain {name}")
+	}
+	d := &dnsLeakCheck{
+		zone:        strings.Trim(zone, "."),
+		api:         api,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		local:       make(map[string]bool),
+		dialTimeout: dialTimeout,
+		rwTimeout:   rwTimeout,
+	}
+	name, err := d.uniqueName()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rwTimeout)
+	defer cancel()
+	// The answer doesn't matter, only that the lookup reached the authority.
+	_, _ = net.DefaultResolver.LookupHost(ctx, name)
+
+	resolvers, err := d.resolvers(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no lookup for %s was logged; check the zone delegation", name)
+	}
+	for _, ip := range resolvers {
+		d.local[ip] = true
+	}
+	return d, nil
+}
+
+// check reports whether the proxy's lookup of a fresh name came from one of
+// the local resolvers. ok is false when the test couldn't be completed (no
+// supported protocol, request failed, nothing logged).
+//
+// auth is offered to SOCKS5 proxies, as in their validation. The request
+// and the log polling are cut short when ctx ends.
+func (d *dnsLeakCheck) check(ctx context.Context, proxyAddr, protocol string, auth *socks5Auth) (leak bool, ok bool) {
+	name, err := d.uniqueName()
+	if err != nil {
+		return false, false
+	}
+	if !d.request(ctx, proxyAddr, protocol, name, auth) {
+		return false, false
+	}
+	resolvers, err := d.resolvers(ctx, name)
+	if err != nil || len(resolvers) == 0 {
+		return false, false
+	}
+	for _, ip := range resolvers {
+		if d.local[ip] {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// request makes the proxy resolve name by asking it for http://name/.
+// The response itself is ignored.
+func (d *dnsLeakCheck) request(ctx context.Context, proxyAddr, protocol, name string, auth *socks5Auth) bool {
+	conn, err := dialPostCheck(ctx, "tcp", proxyAddr, d.dialTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(d.rwTimeout))
+
+	switch protocol {
+	case "http":
+		fmt.Fprintf(conn, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", name, name)
+	case "connect":
+		fmt.Fprintf(conn, "CONNECT %s:80 HTTP/1.1\r\nHost: %s:80\r\n\r\n", name, name)
+	case "socks5":
+		if err := socks5Greet(conn, auth); err != nil {
+			return false
+		}
+		// A failed reply still means the proxy tried to resolve the name.
+		_, _, err := socks5Request(conn, socks5CmdConnect, name, 80)
+		return err == nil || !isTimeout(err)
+	default:
+		return false
+	}
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	return err == nil
+}
+
+// resolvers polls the authority's log for the addresses that queried name.
+// The log is expected to answer GET api (with {name} substituted) with
+// {"resolvers": ["ip", ...]}.
+func (d *dnsLeakCheck) resolvers(ctx context.Context, name string) ([]string, error) {
+	u := strings.ReplaceAll(d.api, "{name}", url.QueryEscape(name))
+	deadline := time.Now().Add(dnsLeakPoll)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var body struct {
+			Resolvers []string `json:"resolvers"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("dns leak log: %s", resp.Status)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(body.Resolvers) > 0 || time.Now().After(deadline) {
+			return body.Resolvers, nil
+		}
+		sleepCtx(ctx, 250*time.Millisecond)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *dnsLeakCheck) uniqueName() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]) + "." + d.zone, nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin)
+
+package main
+
+// raiseFDLimit is a no-op on platforms without RLIMIT_NOFILE; a zero limit
+// means unknown.
+func raiseFDLimit(want uint64) (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// raiseFDLimit tries to raise the soft RLIMIT_NOFILE to want, capped at the
+// hard limit, and returns the soft limit in effect afterwards.
+func raiseFDLimit(want uint64) (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	cur, max := uint64(lim.Cur), uint64(lim.Max)
+	if cur >= want {
+		return cur, nil
+	}
+
+	target := want
+	if target > max {
+		target = max
+	}
+	raised := lim
+	raised.Cur = lim.Cur + (target - cur)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+		return cur, nil
+	}
+	return target, nil
+}
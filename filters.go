@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// subnetKey returns the /24 (IPv4) or /48 (IPv6) network of a host:port.
+func subnetKey(proxy string) string {
+	host, _, err := net.SplitHostPort(proxy)
+	if err != nil {
+		return proxy
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// diversify keeps at most perSubnet results from each subnet, preferring the
+// fastest, and drops the rest from results. It returns the number of kept
+// proxies per subnet and how many were rejected.
+func diversify(results map[string]result, perSubnet int) (map[string]int, int) {
+	ordered := make([]result, 0, len(results))
+	for _, r := range results {
+		ordered = append(ordered, r)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Latency != ordered[j].Latency {
+			return ordered[i].Latency < ordered[j].Latency
+		}
+		return ordered[i].Proxy < ordered[j].Proxy
+	})
+
+	counts := make(map[string]int)
+	rejected := 0
+	for _, r := range ordered {
+		key := subnetKey(r.Proxy)
+		if counts[key] >= perSubnet {
+			delete(results, r.Proxy)
+			rejected++
+			continue
+		}
+		counts[key]++
+	}
+	return counts, rejected
+}
+
+// multiPortListed caps how many -flag-multiport hosts the summary lists.
+const multiPortListed = 10
+
+// multiPortHost is an IP address that validated on several ports.
+type multiPortHost struct {
+	host  string
+	ports int
+}
+
+// flagMultiPort finds the hosts that validated on more than n distinct
+// ports, often honeypots or scanners, and tags their results multiport, or
+// drops them from results if drop is set. It returns the hosts, most ports
+// first.
+func flagMultiPort(results map[string]result, n int, drop bool) []multiPortHost {
+	byHost := make(map[string][]string)
+	for p := range results {
+		if host, _, err := net.SplitHostPort(p); err == nil {
+			byHost[host] = append(byHost[host], p)
+		}
+	}
+	var hosts []multiPortHost
+	for host, proxies := range byHost {
+		if len(proxies) <= n {
+			continue
+		}
+		hosts = append(hosts, multiPortHost{host: host, ports: len(proxies)})
+		for _, p := range proxies {
+			if drop {
+				delete(results, p)
+				continue
+			}
+			r := results[p]
+			r.Tags = append(r.Tags, "multiport")
+			results[p] = r
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].ports != hosts[j].ports {
+			return hosts[i].ports > hosts[j].ports
+		}
+		return hosts[i].host < hosts[j].host
+	})
+	return hosts
+}
+
+// filterCountries drops results whose country isn't in allowed, including
+// those the GeoIP database doesn't cover, and returns how many it dropped.
+func filterCountries(results map[string]result, allowed map[string]bool) int {
+	dropped := 0
+	for p, r := range results {
+		if !allowed[r.Country] {
+			delete(results, p)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// countrySummary renders per-country counts as "CC=N ...", most common
+// first, with proxies the database doesn't cover counted as "unknown".
+func countrySummary(results map[string]result) string {
+	counts := make(map[string]int)
+	for _, r := range results {
+		c := r.Country
+		if c == "" {
+			c = "unknown"
+		}
+		counts[c]++
+	}
+	if len(counts) == 0 {
+		return "none"
+	}
+	codes := make([]string, 0, len(counts))
+	for c := range counts {
+		codes = append(codes, c)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if counts[codes[i]] != counts[codes[j]] {
+			return counts[codes[i]] > counts[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	parts := make([]string, len(codes))
+	for i, c := range codes {
+		parts[i] = fmt.Sprintf("%s=%d", c, counts[c])
+	}
+	return strings.Join(parts, " ")
+}
+
+// fullCapabilities are the capabilities -require-full insists on.
+var fullCapabilities = []string{"http", "connect"}
+
+// requireFull drops results that lack plain HTTP forwarding or CONNECT
+// tunnelling and returns how many of those had at least one of the two.
+func requireFull(results map[string]result) int {
+	partial := 0
+	for p, r := range results {
+		have := 0
+		for _, want := range fullCapabilities {
+			for _, c := range r.Caps {
+				if c == want {
+					have++
+					break
+				}
+			}
+		}
+		if have == len(fullCapabilities) {
+			continue
+		}
+		if have > 0 {
+			partial++
+		}
+		delete(results, p)
+	}
+	return partial
+}
+
+// outputProtocols are the recorded protocols with an -out-<protocol> flag,
+// in the order they are written and summarised.
+var outputProtocols = []string{"http", "connect", "https", "socks4", "socks5"}
+
+// splitByProtocol divides out, keeping its order, by the protocol each
+// proxy validated with.
+func splitByProtocol(out []string, results map[string]result) map[string][]string {
+	by := make(map[string][]string)
+	for _, p := range out {
+		proto := results[p].Protocol
+		by[proto] = append(by[proto], p)
+	}
+	return by
+}
+
+// splitByLatency divides out, keeping its order, into proxies that
+// validated faster than threshold and the rest.
+func splitByLatency(out []string, results map[string]result, threshold time.Duration) (fast, slow []string) {
+	for _, p := range out {
+		if results[p].Latency < threshold {
+			fast = append(fast, p)
+		} else {
+			slow = append(slow, p)
+		}
+	}
+	return fast, slow
+}
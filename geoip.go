@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata map at the end of an MMDB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoDB resolves addresses to ISO country codes from a MaxMind DB file
+// such as GeoLite2-Country or GeoLite2-City. Only the parts of the format
+// needed for that are implemented: the binary search tree and decoding of
+// the data section.
+type geoDB struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// ipv4Start is the node reached after the 96 zero bits that prefix
+	// IPv4 addresses in an IPv6 tree.
+	ipv4Start uint
+}
+
+func loadGeoDB(path string) (*geoDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	meta, _, err := mmdbDecode(buf[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	db := &geoDB{
+		nodeCount:  mmdbUint(m["node_count"]),
+		recordSize: mmdbUint(m["record_size"]),
+		ipVersion:  mmdbUint(m["ip_version"]),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	// The tree is followed by 16 zero bytes, then the data section.
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("search tree larger than file")
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *geoDB) record(node uint, bit byte) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+uint(bit)*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(db.tree[node*8+uint(bit)*4:]))
+	}
+}
+
+// country returns the ISO code of the country of the host of proxy
+// (host:port), falling back to the registered country, or "" when the
+// database has no entry for it.
+func (db *geoDB) country(proxy string) string {
+	host, _, err := net.SplitHostPort(proxy)
+	if err != nil {
+		host = proxy
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return ""
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, ip[i/8]>>(7-uint(i%8))&1)
+	}
+	if node <= db.nodeCount {
+		// Reached the "no data" marker or ran out of bits.
+		return ""
+	}
+	v, _, err := mmdbDecode(db.data, node-db.nodeCount-16)
+	if err != nil {
+		return ""
+	}
+	rec, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := rec[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+func mmdbUint(v interface{}) uint {
+	switch n := v.(type) {
+	case uint64:
+		return uint(n)
+	}
+	return 0
+}
+
+var errMMDBData = errors.New("malformed MaxMind DB data")
+
+// mmdbDecode decodes the data section value at off in data and returns it
+// with the offset just past it. Maps decode to map[string]interface{},
+// arrays to []interface{} and unsigned integers of every width to uint64.
+func mmdbDecode(data []byte, off uint) (interface{}, uint, error) {
+	if off >= uint(len(data)) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := data[off]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// Pointer: the value lives elsewhere in the data section.
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		if off+ss+1 > uint(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		var p uint
+		switch ss {
+		case 0:
+			p = vvv<<8 | uint(data[off])
+		case 1:
+			p = (vvv<<16 | uint(data[off])<<8 | uint(data[off+1])) + 2048
+		case 2:
+			p = (vvv<<24 | uint(data[off])<<16 | uint(data[off+1])<<8 | uint(data[off+2])) + 526336
+		default:
+			p = uint(binary.BigEndian.Uint32(data[off:]))
+		}
+		v, _, err := mmdbDecode(data, p)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		if off >= uint(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		typ = 7 + uint(data[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		ext := uint(0)
+		for _, b := range data[off : off+n] {
+			ext = ext<<8 | uint(b)
+		}
+		size = []uint{29, 285, 65821}[n-1] + ext
+		off += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			v, next, err := mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], off = v, next
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecode(data, off)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, v), next
+		}
+		return a, off, nil
+	case 14: // boolean, the value is the size
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(data)) {
+		return nil, 0, errMMDBData
+	}
+	b := data[off : off+size]
+	off += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case 5, 6, 9, 10: // uint16, uint32, uint64, uint128 (truncated)
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, off, nil
+	case 8: // int32
+		n := int32(0)
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		return n, off, nil
+	default: // bytes and anything newer are returned raw
+		return b, off, nil
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+)
+
+// stdinSource is the source name given to candidates read with -stdin.
+const stdinSource = "stdin"
+
+// ndjsonCandidate is one structured candidate in NDJSON input.
+type ndjsonCandidate struct {
+	Address  string `json:"address"`
+	Protocol string `json:"protocol"`
+}
+
+// readCandidates feeds candidates from r into out. Input whose first
+// non-blank byte is '{' is decoded as a stream of NDJSON candidate objects,
+// honouring each object's protocol hint; anything else is scanned line by
+// line with the configured extraction. Gzipped input and .tar.gz archives
+// are unpacked first, and each archive entry is read on its own.
+func readCandidates(ctx context.Context, r io.Reader, out chan<- candidate, st *stats, ex *extractor) error {
+	return eachEntry(r, func(er io.Reader) error {
+		return readList(ctx, er, out, st, ex)
+	})
+}
+
+func readList(ctx context.Context, r io.Reader, out chan<- candidate, st *stats, ex *extractor) error {
+	br := bufio.NewReaderSize(r, 256*1024)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		_, _ = br.ReadByte()
+	}
+
+	b, _ := br.Peek(1)
+	if b[0] == '{' {
+		return readNDJSON(ctx, br, out, st)
+	}
+
+	src := Source{Name: stdinSource, SOCKSAuth: true}
+	sc := bufio.NewScanner(br)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		atomic.AddUint64(&st.linesRead, 1)
+		atomic.AddUint64(&st.source(stdinSource).lines, 1)
+		if !emitMatches(ctx, sc.Text(), src, out, st, ex) {
+			return ctx.Err()
+		}
+	}
+	return sc.Err()
+}
+
+func readNDJSON(ctx context.Context, r io.Reader, out chan<- candidate, st *stats) error {
+	dec := json.NewDecoder(r)
+	for {
+		var nc ndjsonCandidate
+		if err := dec.Decode(&nc); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		atomic.AddUint64(&st.linesRead, 1)
+
+		hint, addr := splitProxyURL(nc.Address)
+		addr, ok := canonicalHostPort(addr)
+		if !ok {
+			continue
+		}
+		atomic.AddUint64(&st.found, 1)
+		c := candidate{Addr: addr, Source: stdinSource, Protocol: normalizeMode(nc.Protocol), Auth: true}
+		if c.Protocol == "" {
+			c.Protocol = hint
+		}
+		select {
+		case out <- c:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// JSON sources are APIs that return proxies as a JSON array, possibly spread
+// over several pages. The sources file attributes
+//
+//	json:PATH     dot-separated path to the array ("" = the document itself)
+//	next:PATH     path to the next page's URL or cursor (default "next")
+//	cursor:PARAM  send the next value as this query parameter on the
+//	              current URL instead of following it as a URL
+//
+// describe the layout, e.g. "api|json:data.proxies|next:meta.next=URL".
+
+const (
+	// maxJSONPages caps how many pages one source is followed for.
+	maxJSONPages = 100
+	// maxJSONPageBytes caps the decoded size of one page.
+	maxJSONPageBytes = 32 << 20
+)
+
+// fetchJSONSource fetches src page by page, sending the candidates of each
+// array element to out. A failed first page fails the source; a failed
+// later page ends it with the candidates found so far.
+func fetchJSONSource(ctx context.Context, client *http.Client, src Source, out chan<- candidate, st *stats, userAgent string, retries int, ex *extractor) {
+	ss := st.source(src.Name)
+	start := time.Now()
+	var (
+		pages, items int
+		bytesRead    int64
+		seen         = make(map[string]bool)
+	)
+	for u := src.URL; u != "" && pages < maxJSONPages && !seen[u]; pages++ {
+		seen[u] = true
+		doc, n, err := fetchJSONPage(ctx, client, src, u, userAgent, retries)
+		bytesRead += n
+		if err != nil {
+			if pages == 0 {
+				sourceFailed(ctx, ss, src, u, err)
+				return
+			}
+			if ctx.Err() == nil {
+				ss.timedOut = isTimeout(err)
+				slog.Warn("source page fetch failed", "source", src.Name, "url", u, "page", pages+1, "error", err)
+			}
+			break
+		}
+		list, ok := jsonLookup(doc, src.JSONPath)
+		arr, isArr := list.([]any)
+		if !ok || !isArr {
+			err := errors.New("no JSON array at " + strconv.Quote(src.JSONPath))
+			if pages == 0 {
+				sourceFailed(ctx, ss, src, u, err)
+				return
+			}
+			slog.Warn("source page fetch failed", "source", src.Name, "url", u, "page", pages+1, "error", err)
+			break
+		}
+		if pages == 0 {
+			atomic.AddUint64(&st.fetchedOK, 1)
+			atomic.AddUint64(&ss.fetchedOK, 1)
+		}
+		for _, item := range arr {
+			items++
+			atomic.AddUint64(&st.linesRead, 1)
+			atomic.AddUint64(&ss.lines, 1)
+			if !emitMatches(ctx, jsonItemText(item), src, out, st, ex) {
+				return
+			}
+		}
+		next, _ := jsonLookup(doc, src.NextPath)
+		u = nextPageURL(u, jsonScalar(next), src.CursorParam)
+	}
+	slog.Debug("source fetched", "source", src.Name, "url", src.URL, "pages", pages, "bytes", bytesRead, "lines", items, "found", atomic.LoadUint64(&ss.found), "duration", time.Since(start))
+}
+
+// fetchJSONPage fetches and decodes one page, returning the raw bytes read.
+func fetchJSONPage(ctx context.Context, client *http.Client, src Source, rawURL, userAgent string, retries int) (any, int64, error) {
+	resp, body, decoded, err := openSource(ctx, client, src, rawURL, "application/json,*/*;q=0.5", userAgent, retries)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(io.LimitReader(decoded, maxJSONPageBytes))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, body.n, errors.New("invalid JSON: " + err.Error())
+	}
+	return doc, body.n, nil
+}
+
+// jsonLookup follows a dot-separated path of object keys and array
+// indexes from doc.
+func jsonLookup(doc any, path string) (any, bool) {
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonScalar returns a string or number as text, and anything else
+// (including null) as "".
+func jsonScalar(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// jsonItemText turns one array element into text for extraction: strings
+// as they are, objects with an ip/host/address and a port field as
+// host:port, and anything else as its JSON encoding, which the usual
+// patterns then search. An object's protocol or type field, as mixed
+// protocol APIs send, becomes a scheme prefix and so the candidate's
+// protocol hint. Field names match regardless of case.
+func jsonItemText(item any) string {
+	switch v := item.(type) {
+	case string:
+		return v
+	case map[string]any:
+		scheme := jsonItemScheme(v)
+		port := jsonScalar(jsonField(v, "port"))
+		for _, key := range []string{"ip", "host", "address", "addr"} {
+			if host := jsonScalar(jsonField(v, key)); host != "" && port != "" {
+				return scheme + net.JoinHostPort(host, port)
+			}
+		}
+		if p := jsonScalar(jsonField(v, "proxy")); p != "" {
+			if strings.Contains(p, "://") {
+				return p
+			}
+			return scheme + p
+		}
+	}
+	b, _ := json.Marshal(item)
+	return string(b)
+}
+
+// jsonField returns obj's field key, matched regardless of case.
+func jsonField(obj map[string]any, key string) any {
+	if v, ok := obj[key]; ok {
+		return v
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// jsonItemScheme returns "scheme://" for the first protocol named by obj's
+// protocol or type field (a string or a list, such as ["SOCKS4"]) that is
+// a validation mode, or "" for none.
+func jsonItemScheme(obj map[string]any) string {
+	for _, key := range []string{"protocol", "protocols", "type", "types"} {
+		var names []any
+		switch f := jsonField(obj, key).(type) {
+		case string:
+			names = []any{f}
+		case []any:
+			names = f
+		}
+		for _, name := range names {
+			if s := strings.ToLower(jsonScalar(name)); schemeMode(s) != "" {
+				return s + "://"
+			}
+		}
+	}
+	return ""
+}
+
+// nextPageURL returns the URL of the page after cur given the next value
+// from it: next itself, resolved against cur, or with cursorParam set, cur
+// with that query parameter set to next. An empty next ends pagination.
+func nextPageURL(cur, next, cursorParam string) string {
+	if next == "" {
+		return ""
+	}
+	base, err := url.Parse(cur)
+	if err != nil {
+		return ""
+	}
+	if cursorParam != "" {
+		q := base.Query()
+		q.Set(cursorParam, next)
+		base.RawQuery = q.Encode()
+		return base.String()
+	}
+	ref, err := url.Parse(next)
+	if err != nil {
+		return ""
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONItemProtocolHint(t *testing.T) {
+	tests := []struct {
+		item     string
+		addr     string
+		protocol string
+	}{
+		{`{"ip": "1.2.3.4", "port": 8080}`, "1.2.3.4:8080", ""},
+		{`{"ip": "1.2.3.4", "port": 1080, "protocol": "socks5"}`, "1.2.3.4:1080", "socks5"},
+		{`{"Ip": "1.2.3.4", "Port": 1080, "Type": ["SOCKS4"]}`, "1.2.3.4:1080", "socks4"},
+		{`{"Ip": "1.2.3.4", "Port": 443, "Type": ["HTTPS", "HTTP"]}`, "1.2.3.4:443", "connect"},
+		{`{"host": "1.2.3.4", "port": "3128", "type": "elite"}`, "1.2.3.4:3128", ""},
+		{`{"proxy": "1.2.3.4:3128", "protocols": ["http"]}`, "1.2.3.4:3128", "http"},
+		{`{"proxy": "socks5://1.2.3.4:1080", "protocol": "http"}`, "1.2.3.4:1080", "socks5"},
+	}
+	for _, tt := range tests {
+		// Pages are decoded with UseNumber, as in fetchJSONPage.
+		dec := json.NewDecoder(strings.NewReader(tt.item))
+		dec.UseNumber()
+		var item any
+		if err := dec.Decode(&item); err != nil {
+			t.Fatal(err)
+		}
+		out := make(chan candidate, 1)
+		st := &stats{perSource: map[string]*sourceStats{}}
+		emitMatches(context.Background(), jsonItemText(item), Source{Name: "api"}, out, st, &extractor{})
+		close(out)
+		c, ok := <-out
+		if !ok || c.Addr != tt.addr || c.Protocol != tt.protocol {
+			t.Errorf("%s: candidate %+v, want %s with protocol %q", tt.item, c, tt.addr, tt.protocol)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// cacheSource is the source name of candidates re-validated from -cache.
+const cacheSource = "cache"
+
+// loadKnownCache reads the -cache file of results from earlier runs. A
+// missing file is an empty cache.
+func loadKnownCache(path string) ([]result, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []result
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// splitFreshCache divides cached results into those checked within maxAge
+// of now, which -skip-cached reuses, and older ones, which are validated
+// again. Entries without a check time count as old. A zero maxAge keeps
+// every entry fresh.
+func splitFreshCache(cached []result, maxAge time.Duration, now time.Time) (fresh, expired []result) {
+	for _, r := range cached {
+		if maxAge > 0 && (r.CheckedAt.IsZero() || now.Sub(r.CheckedAt) > maxAge) {
+			expired = append(expired, r)
+		} else {
+			fresh = append(fresh, r)
+		}
+	}
+	return fresh, expired
+}
+
+// saveKnownCache replaces the -cache file with results. The file is
+// written under a unique temporary name and renamed into place, so
+// concurrent runs never leave a torn file behind; the last one to finish
+// wins.
+func saveKnownCache(path string, results map[string]result) error {
+	res := make([]result, 0, len(results))
+	for _, r := range results {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Proxy < res[j].Proxy })
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, b)
+}
+
+// replaceFile writes b to a unique temporary file next to path, syncs it
+// and renames it over path. Readers see the old contents or the new ones,
+// never a torn file, and the temporary file is removed on failure.
+func replaceFile(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// Without the sync a crash after the rename can leave an empty file
+	// in the target's place.
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// resultCache is a fixed-size LRU of recent validation verdicts keyed by
+// proxy address. Entries older than ttl are treated as missing.
+type resultCache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	proxy string
+	res   result
+	ok    bool
+	at    time.Time
+}
+
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *resultCache) get(proxy string) (result, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[proxy]
+	if !ok {
+		return result{}, false, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Since(e.at) > c.ttl {
+		c.order.Remove(el)
+		delete(c.items, proxy)
+		return result{}, false, false
+	}
+	c.order.MoveToFront(el)
+	return e.res, e.ok, true
+}
+
+func (c *resultCache) put(proxy string, res result, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[proxy]; found {
+		el.Value = &cacheEntry{proxy: proxy, res: res, ok: ok, at: time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[proxy] = c.order.PushFront(&cacheEntry{proxy: proxy, res: res, ok: ok, at: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).proxy)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// serveMetrics serves the run's counters in the Prometheus text format on
+// addr until ctx ends. st.perSource must be fully populated before it is
+// called.
+func serveMetrics(ctx context.Context, addr string, st *stats) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, st)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	slog.Info("metrics listening", "addr", addr)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+func writeMetrics(w io.Writer, st *stats) {
+	counters := []struct {
+		name, help string
+		v          *uint64
+	}{
+		{"proxy_scraper_sources_fetched_total", "Sources fetched successfully.", &st.fetchedOK},
+		{"proxy_scraper_lines_read_total", "Lines read from sources.", &st.linesRead},
+		{"proxy_scraper_candidates_found_total", "Candidates matched in source lines.", &st.found},
+		{"proxy_scraper_candidates_enqueued_total", "Unique candidates queued for validation.", &st.enqueued},
+		{"proxy_scraper_proxies_valid_total", "Proxies that passed validation.", &st.valid},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, atomic.LoadUint64(c.v))
+	}
+	fmt.Fprintf(w, "# HELP proxy_scraper_validations_in_flight Candidates being validated right now.\n# TYPE proxy_scraper_validations_in_flight gauge\nproxy_scraper_validations_in_flight %d\n", atomic.LoadInt64(&st.inFlight))
+
+	names := make([]string, 0, len(st.perSource))
+	for name := range st.perSource {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	perSource := []struct {
+		name, help, kind string
+		v                func(*sourceStats) uint64
+	}{
+		{"proxy_scraper_source_up", "Whether the source was fetched successfully.", "gauge", func(ss *sourceStats) uint64 { return atomic.LoadUint64(&ss.fetchedOK) }},
+		{"proxy_scraper_source_found_total", "Candidates matched per source.", "counter", func(ss *sourceStats) uint64 { return atomic.LoadUint64(&ss.found) }},
+		{"proxy_scraper_source_valid_total", "Valid proxies per source.", "counter", func(ss *sourceStats) uint64 { return atomic.LoadUint64(&ss.valid) }},
+	}
+	for _, m := range perSource {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{source=%s} %d\n", m.name, strconv.Quote(name), m.v(st.perSource[name]))
+		}
+	}
+}
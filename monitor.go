@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type monitorEntry struct {
+	checks    int
+	successes int
+	lastOK    time.Time
+}
+
+// runMonitor re-validates a fixed proxy list every interval until ctx is
+// cancelled, printing a per-proxy uptime table after each round.
+func runMonitor(ctx context.Context, proxies []string, interval time.Duration, workers int, check func(string) bool) {
+	entries := make(map[string]*monitorEntry, len(proxies))
+	for _, p := range proxies {
+		entries[p] = &monitorEntry{}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for round := 1; ; round++ {
+		up := monitorRound(ctx, proxies, workers, check, entries)
+		if ctx.Err() != nil {
+			return
+		}
+		printMonitorTable(os.Stdout, round, up, proxies, entries)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func monitorRound(ctx context.Context, proxies []string, workers int, check func(string) bool, entries map[string]*monitorEntry) int {
+	jobs := make(chan string)
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+		up int
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				ok := check(p)
+				if ctx.Err() != nil {
+					// Don't count probes cut short by shutdown as failures.
+					continue
+				}
+				mu.Lock()
+				e := entries[p]
+				e.checks++
+				if ok {
+					e.successes++
+					e.lastOK = time.Now()
+					up++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, p := range proxies {
+		select {
+		case jobs <- p:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return up
+}
+
+func printMonitorTable(w io.Writer, round, up int, proxies []string, entries map[string]*monitorEntry) {
+	fmt.Fprintf(w, "round %d @ %s | up: %d/%d\n", round, time.Now().Format("15:04:05"), up, len(proxies))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROXY\tUPTIME\tCHECKS\tLAST OK")
+	for _, p := range proxies {
+		e := entries[p]
+		uptime := 0.0
+		if e.checks > 0 {
+			uptime = 100 * float64(e.successes) / float64(e.checks)
+		}
+		last := "-"
+		if !e.lastOK.IsZero() {
+			last = e.lastOK.Format("15:04:05")
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%d\t%s\n", p, uptime, e.checks, last)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+}
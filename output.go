@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// OutputSink renders the final, sorted proxy list in one output format.
+type OutputSink interface {
+	Write(w io.Writer, out []string, results map[string]result) error
+}
+
+// outputTarget is one -out path and the sink chosen for it.
+type outputTarget struct {
+	Path string
+	Sink OutputSink
+	// Append adds to an existing file instead of replacing it (-append).
+	Append bool
+	// Gzip compresses the file (a .gz path or -gzip). Appending adds a new
+	// gzip member, which gunzip and zcat read as one stream.
+	Gzip bool
+}
+
+// parseOutputs splits a comma-separated -out value into targets, inferring
+// each format from the file extension: .json, .ndjson (or .jsonl) and .csv
+// get structured output, anything else the format chosen with -format. A
+// trailing .gz marks the target compressed and the extension before it
+// picks the format, so proxies.json.gz is gzipped JSON.
+func parseOutputs(spec, format string, withScheme, csvExtra bool, vocab string, asns *asnDB) []outputTarget {
+	var targets []outputTarget
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		var sink OutputSink
+		ext := strings.ToLower(filepath.Ext(p))
+		gz := ext == ".gz"
+		if gz {
+			ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(p, filepath.Ext(p))))
+		}
+		switch ext {
+		case ".json":
+			sink = jsonSink{vocab: vocab}
+		case ".ndjson", ".jsonl":
+			sink = ndjsonSink{vocab: vocab}
+		case ".csv":
+			sink = csvSink{vocab: vocab, extra: csvExtra}
+		default:
+			switch format {
+			case "json":
+				sink = jsonSink{vocab: vocab}
+			case "ndjson":
+				sink = ndjsonSink{vocab: vocab}
+			case "csv":
+				sink = csvSink{vocab: vocab, extra: csvExtra}
+			case "by-asn":
+				sink = byASNSink{db: asns, text: textSink{withScheme: withScheme, vocab: vocab}}
+			default:
+				sink = textSink{withScheme: withScheme, vocab: vocab}
+			}
+		}
+		targets = append(targets, outputTarget{Path: p, Sink: sink, Gzip: gz})
+	}
+	return targets
+}
+
+// outputSet is every target a run writes: -out (with -evidence-out), the
+// latency tiers and the -out-<protocol> lists.
+type outputSet struct {
+	main, fast, slow []outputTarget
+	// proto holds the -out-<protocol> targets by recorded protocol.
+	proto map[string][]outputTarget
+}
+
+// newOutputSet parses the output flags into targets, applying -template,
+// -gzip and -append to each.
+func newOutputSet(c *config, asns *asnDB) (*outputSet, error) {
+	o := &outputSet{
+		main:  parseOutputs(c.outFile, c.format, c.withScheme, c.csvExtra, c.labels, asns),
+		fast:  parseOutputs(c.outFast, c.format, c.withScheme, c.csvExtra, c.labels, asns),
+		slow:  parseOutputs(c.outSlow, c.format, c.withScheme, c.csvExtra, c.labels, asns),
+		proto: make(map[string][]outputTarget),
+	}
+	if len(o.main) == 0 {
+		return nil, errors.New("-out needs at least one path")
+	}
+	for proto, spec := range map[string]string{
+		"http":    c.outHTTP,
+		"connect": c.outCONNECT,
+		"https":   c.outHTTPS,
+		"socks4":  c.outSOCKS4,
+		"socks5":  c.outSOCKS5,
+	} {
+		if targets := parseOutputs(spec, c.format, c.withScheme, c.csvExtra, c.labels, asns); len(targets) > 0 {
+			o.proto[proto] = targets
+		}
+	}
+	// -template swaps the plain text sink of targets.
+	if c.tmplSpec != "" {
+		tmpl, err := parseTemplate(c.tmplSpec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -template: %w", err)
+		}
+		for _, targets := range o.all() {
+			for i := range targets {
+				if _, ok := targets[i].Sink.(textSink); ok {
+					targets[i].Sink = templateSink{tmpl: tmpl, vocab: c.labels}
+				}
+			}
+		}
+	}
+	if c.evidenceOut != "" {
+		o.main = append(o.main, outputTarget{Path: c.evidenceOut, Sink: evidenceSink{}})
+	}
+	for _, targets := range o.all() {
+		for i := range targets {
+			targets[i].Gzip = targets[i].Gzip || c.gzipOut
+			if c.appendOut {
+				switch targets[i].Sink.(type) {
+				case textSink, templateSink, ndjsonSink:
+					targets[i].Append = true
+				}
+			}
+		}
+	}
+	return o, nil
+}
+
+// all lists the target groups of the set, -out first.
+func (o *outputSet) all() [][]outputTarget {
+	groups := [][]outputTarget{o.main, o.fast, o.slow}
+	for _, proto := range outputProtocols {
+		if targets := o.proto[proto]; len(targets) > 0 {
+			groups = append(groups, targets)
+		}
+	}
+	return groups
+}
+
+// writeRetryBase is the delay before the first output write retry; it
+// doubles with each further attempt.
+const writeRetryBase = 500 * time.Millisecond
+
+// writeOutput writes out to every target. A failed write is retried up to
+// retries times with backoff; if it still fails, the output goes to a temp
+// file (or stdout as a last resort) so the run's results aren't lost, and
+// the error names where they went.
+func writeOutput(targets []outputTarget, out []string, results map[string]result, retries int) error {
+	var failed []string
+	for _, t := range targets {
+		err := writeSink(t, out, results)
+		for i := 0; err != nil && i < retries; i++ {
+			delay := writeRetryBase << i
+			slog.Warn("output write failed, retrying", "path", t.Path, "error", err, "delay", delay)
+			time.Sleep(delay)
+			err = writeSink(t, out, results)
+		}
+		if err == nil {
+			continue
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v (saved to %s)", t.Path, err, writeFallback(t, out, results)))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// writeFallback saves a target's output to a temp file, or prints it to
+// stdout if that fails too, and returns where it went.
+func writeFallback(t outputTarget, out []string, results map[string]result) string {
+	f, err := os.CreateTemp("", "proxy-scraper-*"+filepath.Ext(t.Path))
+	if err == nil {
+		tmp := outputTarget{Path: f.Name(), Sink: t.Sink, Gzip: t.Gzip}
+		f.Close()
+		if writeSink(tmp, out, results) == nil {
+			return tmp.Path
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	_ = t.Sink.Write(w, out, results)
+	_ = w.Flush()
+	return "stdout"
+}
+
+// writeSink writes one target. A replaced file is written to a temp file
+// next to it and renamed into place, so a run killed mid-write leaves the
+// previous output intact. Targets that aren't regular files, such as
+// /dev/stdout or a symlink, are written directly, as they are when no temp
+// file can be created there or the rename fails.
+func writeSink(t outputTarget, out []string, results map[string]result) error {
+	if t.Append {
+		return writeSinkTo(t, out, results, t.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND)
+	}
+	// The replacement keeps the target's permissions, and a new target gets
+	// the umask-filtered 0666 a plain os.Create would have given it.
+	perm := os.FileMode(0o666) &^ os.FileMode(processUmask)
+	if fi, err := os.Lstat(t.Path); err == nil {
+		if !fi.Mode().IsRegular() {
+			return writeSinkTo(t, out, results, t.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+		}
+		perm = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(t.Path), filepath.Base(t.Path)+".*.tmp")
+	if err != nil {
+		return writeSinkTo(t, out, results, t.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	}
+	tmp := f.Name()
+	f.Close()
+	if err := writeSinkTo(t, out, results, tmp, os.O_WRONLY|os.O_TRUNC); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncFile(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// CreateTemp makes the file private.
+	_ = os.Chmod(tmp, perm)
+	if err := os.Rename(tmp, t.Path); err != nil {
+		os.Remove(tmp)
+		return writeSinkTo(t, out, results, t.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	}
+	return nil
+}
+
+// syncFile flushes a written file to disk, so renaming it over the target
+// can't leave an empty file behind after a crash.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeSinkTo(t outputTarget, out []string, results map[string]result, path string, flags int) error {
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	var gz *gzip.Writer
+	var dst io.Writer = f
+	if t.Gzip {
+		gz = gzip.NewWriter(f)
+		dst = gz
+	}
+	w := bufio.NewWriterSize(dst, 256*1024)
+	if err := t.Sink.Write(w, out, results); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	// Close writes the gzip footer; without it the file is truncated.
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// textSink writes one proxy per line, as rendered by renderLines.
+type textSink struct {
+	withScheme bool
+	vocab      string
+}
+
+func (s textSink) Write(w io.Writer, out []string, results map[string]result) error {
+	for _, line := range renderLines(out, results, s.withScheme, s.vocab) {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateSink writes one line per proxy rendered with the -template
+// text/template.
+type templateSink struct {
+	tmpl  *template.Template
+	vocab string
+}
+
+// templateData is what a -template is evaluated against.
+type templateData struct {
+	Proxy     string
+	IP        string
+	Port      string
+	Protocol  string
+	LatencyMS int64
+	Source    string
+	Country   string
+	Anonymity string
+	Tags      []string
+}
+
+// parseTemplate compiles a -template and renders it once against a sample
+// proxy, so unknown fields and other mistakes fail at startup rather than
+// on the first line of output.
+func parseTemplate(spec string) (*template.Template, error) {
+	tmpl, err := template.New("template").Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	sample := newTemplateData(result{Proxy: "192.0.2.1:8080", Protocol: "http", Source: "sample"}, "connect")
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func newTemplateData(r result, vocab string) templateData {
+	host, port, _ := net.SplitHostPort(r.Proxy)
+	return templateData{
+		Proxy:     r.Proxy,
+		IP:        host,
+		Port:      port,
+		Protocol:  protocolLabel(r.Protocol, vocab),
+		LatencyMS: r.Latency.Milliseconds(),
+		Source:    r.Source,
+		Country:   r.Country,
+		Anonymity: r.Anonymity,
+		Tags:      r.Tags,
+	}
+}
+
+func (s templateSink) Write(w io.Writer, out []string, results map[string]result) error {
+	for _, p := range out {
+		if err := s.tmpl.Execute(w, newTemplateData(results[p], s.vocab)); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputRecord is the structured form of a result in JSON output.
+type outputRecord struct {
+	Proxy        string   `json:"proxy"`
+	Protocol     string   `json:"protocol"`
+	LatencyMS    int64    `json:"latency_ms"`
+	Source       string   `json:"source"`
+	Tags         []string `json:"tags,omitempty"`
+	TLS          string   `json:"tls,omitempty"`
+	DNSLeak      *bool    `json:"dns_leak,omitempty"`
+	FrontConnect string   `json:"front_connect,omitempty"`
+	FrontSNI     string   `json:"front_sni,omitempty"`
+	Anonymity    string   `json:"anonymity,omitempty"`
+	Country      string   `json:"country,omitempty"`
+}
+
+func newOutputRecord(r result, vocab string) outputRecord {
+	return outputRecord{
+		Proxy:        r.Proxy,
+		Protocol:     protocolLabel(r.Protocol, vocab),
+		LatencyMS:    r.Latency.Milliseconds(),
+		Source:       r.Source,
+		Tags:         r.Tags,
+		TLS:          r.TLS,
+		DNSLeak:      r.DNSLeak,
+		FrontConnect: r.FrontConnect,
+		FrontSNI:     r.FrontSNI,
+		Anonymity:    r.Anonymity,
+		Country:      r.Country,
+	}
+}
+
+// jsonSink writes the results as an indented JSON array.
+type jsonSink struct {
+	vocab string
+}
+
+func (s jsonSink) Write(w io.Writer, out []string, results map[string]result) error {
+	recs := make([]outputRecord, len(out))
+	for i, p := range out {
+		recs[i] = newOutputRecord(results[p], s.vocab)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(recs)
+}
+
+// ndjsonSink writes one compact JSON object per line, with the same fields
+// as jsonSink. Unlike the array, every line stands on its own, so the file
+// can be streamed (-stream), appended to, and read up to a truncated last
+// line.
+type ndjsonSink struct {
+	vocab string
+}
+
+func (s ndjsonSink) Write(w io.Writer, out []string, results map[string]result) error {
+	enc := json.NewEncoder(w)
+	for _, p := range out {
+		if err := enc.Encode(newOutputRecord(results[p], s.vocab)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvSink writes the results as CSV with a header row, for spreadsheet
+// import. Every column is always present; fields a run didn't populate,
+// such as country without -geoip, are left empty. With extra (-csv-extra)
+// the anonymity, tags, tls and dns_leak columns follow, tags joined with
+// ';'.
+type csvSink struct {
+	vocab string
+	extra bool
+}
+
+func (s csvSink) Write(w io.Writer, out []string, results map[string]result) error {
+	cw := csv.NewWriter(w)
+	header := []string{"ip", "port", "protocol", "latency_ms", "source", "country"}
+	if s.extra {
+		header = append(header, "anonymity", "tags", "tls", "dns_leak")
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, p := range out {
+		rec := newOutputRecord(results[p], s.vocab)
+		host, port, err := net.SplitHostPort(rec.Proxy)
+		if err != nil {
+			host = rec.Proxy
+		}
+		row := []string{
+			host,
+			port,
+			rec.Protocol,
+			strconv.FormatInt(rec.LatencyMS, 10),
+			rec.Source,
+			rec.Country,
+		}
+		if s.extra {
+			leak := ""
+			if rec.DNSLeak != nil {
+				leak = strconv.FormatBool(*rec.DNSLeak)
+			}
+			row = append(row, rec.Anonymity, strings.Join(rec.Tags, ";"), rec.TLS, leak)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// byASNSink writes the text list grouped under a "# AS<n> <org> (<count>)"
+// header per autonomous system, largest groups first. Proxies the database
+// doesn't cover are grouped under "# unknown".
+type byASNSink struct {
+	db   *asnDB
+	text textSink
+}
+
+func (s byASNSink) Write(w io.Writer, out []string, results map[string]result) error {
+	type group struct {
+		header  string
+		asn     uint32
+		proxies []string
+	}
+	groups := make(map[uint32]*group)
+	for _, p := range out {
+		rg, ok := s.db.lookup(p)
+		g := groups[rg.asn]
+		if g == nil {
+			g = &group{header: "unknown", asn: rg.asn}
+			if ok {
+				g.header = fmt.Sprintf("AS%d %s", rg.asn, rg.org)
+			}
+			groups[rg.asn] = g
+		}
+		g.proxies = append(g.proxies, p)
+	}
+
+	sorted := make([]*group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.proxies) != len(b.proxies) {
+			return len(a.proxies) > len(b.proxies)
+		}
+		return a.asn < b.asn
+	})
+
+	for i, g := range sorted {
+		if i > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# %s (%d)\n", g.header, len(g.proxies)); err != nil {
+			return err
+		}
+		if err := s.text.Write(w, g.proxies, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evidenceRecord documents why a proxy was included in the output.
+type evidenceRecord struct {
+	Proxy     string    `json:"proxy"`
+	Mode      string    `json:"mode"`
+	Status    string    `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+	Source    string    `json:"source"`
+	Tags      []string  `json:"tags,omitempty"`
+	// Set for proxies that passed the domain fronting check.
+	FrontConnect string `json:"front_connect,omitempty"`
+	FrontSNI     string `json:"front_sni,omitempty"`
+}
+
+// evidenceSink writes the -evidence-out manifest: a JSON array with the
+// validation evidence of every proxy in the output.
+type evidenceSink struct{}
+
+func (evidenceSink) Write(w io.Writer, out []string, results map[string]result) error {
+	recs := make([]evidenceRecord, len(out))
+	for i, p := range out {
+		r := results[p]
+		recs[i] = evidenceRecord{
+			Proxy:        r.Proxy,
+			Mode:         r.Protocol,
+			Status:       r.Status,
+			LatencyMS:    r.Latency.Milliseconds(),
+			CheckedAt:    r.CheckedAt,
+			Source:       r.Source,
+			Tags:         r.Tags,
+			FrontConnect: r.FrontConnect,
+			FrontSNI:     r.FrontSNI,
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(recs)
+}
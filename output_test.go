@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVSinkColumns(t *testing.T) {
+	results := map[string]result{
+		"[::1]:8080": {Proxy: "[::1]:8080", Protocol: "http", Latency: 12 * time.Millisecond, Source: "a,b", Tags: []string{"x", "y"}},
+	}
+	out := []string{"[::1]:8080"}
+	tests := []struct {
+		extra bool
+		want  string
+	}{
+		{false, "ip,port,protocol,latency_ms,source,country\n::1,8080,http,12,\"a,b\",\n"},
+		{true, "ip,port,protocol,latency_ms,source,country,anonymity,tags,tls,dns_leak\n::1,8080,http,12,\"a,b\",,,x;y,,\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := (csvSink{vocab: "connect", extra: tt.extra}).Write(&b, out, results); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("extra=%v: got %q, want %q", tt.extra, b.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// progressEvery is how often -progress prints the live counters.
+const progressEvery = 5 * time.Second
+
+// startProgress prints the live counters to stderr every progressEvery,
+// with backlog() as the candidates waiting for validation, until ctx ends or the
+// returned stop is called. Either way it prints a final line; stop waits
+// for it.
+func startProgress(ctx context.Context, st *stats, backlog func() int) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		start := time.Now()
+		t := time.NewTicker(progressEvery)
+		defer t.Stop()
+		var lastValid uint64
+		last := start
+		for {
+			select {
+			case now := <-t.C:
+				valid := atomic.LoadUint64(&st.valid)
+				rate := float64(valid-lastValid) / now.Sub(last).Seconds()
+				printProgress(st, backlog(), now.Sub(start), rate, false)
+				lastValid, last = valid, now
+			case <-ctx.Done():
+				printProgressFinal(st, backlog(), start)
+				return
+			case <-quit:
+				printProgressFinal(st, backlog(), start)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+func printProgressFinal(st *stats, queued int, start time.Time) {
+	elapsed := time.Since(start)
+	printProgress(st, queued, elapsed, float64(atomic.LoadUint64(&st.valid))/elapsed.Seconds(), true)
+}
+
+func printProgress(st *stats, queued int, elapsed time.Duration, rate float64, final bool) {
+	msg := "progress"
+	if final {
+		msg = "progress (final)"
+	}
+	slog.Info(msg,
+		"elapsed", elapsed.Round(time.Second),
+		"fetched_ok", atomic.LoadUint64(&st.fetchedOK),
+		"found", atomic.LoadUint64(&st.found),
+		"enqueued", atomic.LoadUint64(&st.enqueued),
+		"queued", queued,
+		"in_flight", atomic.LoadInt64(&st.inFlight),
+		"valid", atomic.LoadUint64(&st.valid),
+		"valid_per_sec", math.Round(rate*10)/10,
+	)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The offset file is rewritten once the committed offset runs this many
+// candidates or this much time ahead of it.
+const (
+	offsetCommitEvery    = 256
+	offsetCommitInterval = time.Second
+)
+
+// workQueue backs the jobs channel with an append log in -queue-dir so an
+// interrupted run can resume. Every deduplicated candidate is appended to
+// queue.log and every valid result to results.log; the offset file records
+// how many leading queue entries are fully checked. A fetched marker is
+// written once all sources have been read.
+type workQueue struct {
+	dir string
+
+	mu        sync.Mutex
+	queueLog  *os.File
+	resultLog *os.File
+	next      int64 // seq of the next appended candidate
+	offset    int64 // all seqs below this are done
+	written   int64 // offset last written to disk
+	writtenAt time.Time
+	finished  map[int64]struct{} // done seqs at or above offset
+
+	// Loaded state from an interrupted run.
+	queued  []candidate
+	pending []candidate
+	results []result
+	fetched bool
+}
+
+// openWorkQueue opens or creates the queue in dir, loading whatever an
+// earlier interrupted run left behind.
+func openWorkQueue(dir string) (*workQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := &workQueue{dir: dir, finished: make(map[int64]struct{})}
+
+	b, err := os.ReadFile(q.path("offset"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		if q.offset, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+		q.written = q.offset
+	}
+	if _, err := os.Stat(q.path("fetched")); err == nil {
+		q.fetched = true
+	}
+
+	var cands []candidate
+	if q.queueLog, err = openAppendLog(q.path("queue.log"), func(line []byte) bool {
+		var c candidate
+		if json.Unmarshal(line, &c) != nil {
+			return false
+		}
+		c.seq = int64(len(cands))
+		cands = append(cands, c)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	q.next = int64(len(cands))
+	if q.offset > q.next {
+		q.offset = q.next
+	}
+	q.queued = cands
+	q.pending = cands[q.offset:]
+
+	if q.resultLog, err = openAppendLog(q.path("results.log"), func(line []byte) bool {
+		var r result
+		if json.Unmarshal(line, &r) != nil {
+			return false
+		}
+		q.results = append(q.results, r)
+		return true
+	}); err != nil {
+		q.queueLog.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// openAppendLog replays the NDJSON log at path through fn and opens it for
+// appending. A torn final line from a crash is cut off so new entries start
+// on a clean line.
+func openAppendLog(path string, fn func([]byte) bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	var good int64
+	br := bufio.NewReaderSize(f, 256*1024)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil || !fn(bytes.TrimSpace(line)) {
+			break
+		}
+		good += int64(len(line))
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(good, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// resumed reports whether an earlier run left any state behind.
+func (q *workQueue) resumed() bool {
+	return q.next > 0 || len(q.results) > 0
+}
+
+// seenKeys calls fn with the dedup key of every candidate already in the
+// queue, checked or not, so a resumed fetch doesn't enqueue them again.
+func (q *workQueue) seenKeys(fn func(key string)) {
+	for _, c := range q.queued {
+		fn(c.dedupKey())
+	}
+}
+
+// push appends a newly enqueued candidate and assigns its sequence number.
+func (q *workQueue) push(c *candidate) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c.seq = q.next
+	q.next++
+	_, err = q.queueLog.Write(append(b, '\n'))
+	return err
+}
+
+// result records a valid result. It must be called before done for the
+// same candidate so a committed offset never covers a lost result.
+func (q *workQueue) result(r result) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, err = q.resultLog.Write(append(b, '\n'))
+	return err
+}
+
+// done marks a candidate as fully checked and advances the committed offset
+// past every contiguous completed entry.
+func (q *workQueue) done(seq int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished[seq] = struct{}{}
+	for {
+		if _, ok := q.finished[q.offset]; !ok {
+			break
+		}
+		delete(q.finished, q.offset)
+		q.offset++
+	}
+	if q.offset == q.written ||
+		(q.offset-q.written < offsetCommitEvery && time.Since(q.writtenAt) < offsetCommitInterval) {
+		return nil
+	}
+	return q.commitLocked()
+}
+
+func (q *workQueue) commitLocked() error {
+	tmp := q.path("offset.tmp")
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(q.offset, 10)+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path("offset")); err != nil {
+		return err
+	}
+	q.written = q.offset
+	q.writtenAt = time.Now()
+	return nil
+}
+
+// markFetched records that every source has been read, so a resumed run
+// only needs to replay the queue.
+func (q *workQueue) markFetched() error {
+	return os.WriteFile(q.path("fetched"), nil, 0o644)
+}
+
+// close commits the current offset. With complete set the run finished
+// and the queue is removed instead.
+func (q *workQueue) close(complete bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queueLog.Close()
+	q.resultLog.Close()
+	if !complete {
+		return q.commitLocked()
+	}
+	for _, name := range []string{"queue.log", "results.log", "offset", "fetched"} {
+		if err := os.Remove(q.path(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *workQueue) path(name string) string {
+	return filepath.Join(q.dir, name)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Exit statuses beyond 1 (a startup or file error), for scripts and cron
+// jobs. When several apply, the lowest wins.
+const (
+	// exitFailUnder: fewer proxies validated than -fail-under.
+	exitFailUnder = 2
+	// exitAlert: an alert threshold was crossed.
+	exitAlert = 3
+	// exitTimeout: -total-timeout ended the run before every candidate
+	// was checked.
+	exitTimeout = 4
+)
+
+// runReport is the machine-readable summary written by -report. The
+// previous report at the same path is the baseline for -alert-drop-pct.
+type runReport struct {
+	Time      time.Time `json:"time"`
+	Sources   int       `json:"sources"`
+	FetchedOK uint64    `json:"fetched_ok"`
+	Lines     uint64    `json:"lines"`
+	Found     uint64    `json:"found"`
+	Enqueued  uint64    `json:"enqueued"`
+	Valid     uint64    `json:"valid"`
+	Wrote     int       `json:"wrote"`
+	TimedOut  bool      `json:"timed_out,omitempty"`
+	Alerts    []string  `json:"alerts"`
+	// PerSource lists the contribution of every source that was fetched;
+	// FailedSources those that errored or answered non-200.
+	PerSource     []sourceReport `json:"per_source"`
+	FailedSources []sourceReport `json:"failed_sources"`
+	// MultiPort lists the -flag-multiport hosts as "ip (N ports)".
+	MultiPort []string `json:"multiport_hosts,omitempty"`
+}
+
+// sourceReport is one source's line in a run report.
+type sourceReport struct {
+	Name     string `json:"name"`
+	URL      string `json:"url,omitempty"`
+	Lines    uint64 `json:"lines"`
+	Found    uint64 `json:"found"`
+	Enqueued uint64 `json:"enqueued"`
+	Valid    uint64 `json:"valid"`
+	// FetchMS is how long the fetch took; TimedOut marks one that hit
+	// -http-timeout, whether it failed outright or was cut off mid-list.
+	FetchMS  int64  `json:"fetch_ms"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sourceReports splits the per-source counters into fetched and failed
+// sources, each ordered by name. Sources the run never got to (cancelled
+// before their fetch started) appear in neither.
+func sourceReports(sources []Source, st *stats) (fetched, failed []sourceReport) {
+	fetched, failed = []sourceReport{}, []sourceReport{}
+	add := func(name, url string) {
+		ss, ok := st.perSource[name]
+		if !ok {
+			return
+		}
+		sr := sourceReport{
+			Name:     name,
+			URL:      url,
+			Lines:    atomic.LoadUint64(&ss.lines),
+			Found:    atomic.LoadUint64(&ss.found),
+			Enqueued: atomic.LoadUint64(&ss.enqueued),
+			Valid:    atomic.LoadUint64(&ss.valid),
+			FetchMS:  ss.fetchTime.Milliseconds(),
+			TimedOut: ss.timedOut,
+			Error:    ss.failure,
+		}
+		switch {
+		case sr.Error != "":
+			failed = append(failed, sr)
+		case atomic.LoadUint64(&ss.fetchedOK) > 0 || url == "":
+			fetched = append(fetched, sr)
+		}
+	}
+	for _, src := range sources {
+		add(src.Name, src.URL)
+	}
+	if _, ok := st.perSource[stdinSource]; ok {
+		add(stdinSource, "")
+	}
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].Name < fetched[j].Name })
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Name < failed[j].Name })
+	return fetched, failed
+}
+
+// timedOutSources returns the names of the sources whose fetch hit
+// -http-timeout, sorted.
+func timedOutSources(st *stats) []string {
+	var names []string
+	for name, ss := range st.perSource {
+		if ss.timedOut {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadReport reads a previous report. A missing file yields nil so the first
+// run has no baseline.
+func loadReport(path string) (*runReport, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r runReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func writeReport(path string, r *runReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// checkAlerts compares cur against the thresholds and the previous run. A
+// validBelow or dropPct of zero disables that check.
+func checkAlerts(cur, prev *runReport, validBelow int, dropPct float64) []string {
+	alerts := []string{}
+	if validBelow > 0 && cur.Valid < uint64(validBelow) {
+		alerts = append(alerts, fmt.Sprintf("valid proxies %d below threshold %d", cur.Valid, validBelow))
+	}
+	if dropPct > 0 && prev != nil && prev.Valid > 0 && cur.Valid < prev.Valid {
+		drop := 100 * float64(prev.Valid-cur.Valid) / float64(prev.Valid)
+		if drop > dropPct {
+			alerts = append(alerts, fmt.Sprintf("valid proxies dropped %.1f%% from %d to %d (threshold %.1f%%)", drop, prev.Valid, cur.Valid, dropPct))
+		}
+	}
+	return alerts
+}
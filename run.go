@@ -0,0 +1,1366 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// run is one scrape. Its stages run in order: loadSources, startFetch
+// feeding raw, startDedup moving unique candidates from raw to jobs,
+// startValidation and collect gathering the valid results, then filter,
+// writeOutputs, printSummary and finish.
+type run struct {
+	cfg *config
+	v   *validator
+	ex  *extractor
+
+	// Post-validation checks, nil when their flags are off.
+	front     *frontCheck
+	headerReq *probeRequest
+	anon      *anonymityCheck
+	leaks     *dnsLeakCheck
+
+	// recheck is the -revalidate list.
+	recheck   []candidate
+	geo       *geoDB
+	countries map[string]bool
+	outputs   *outputSet
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// stopProgress ends -progress output once validation is over.
+	stopProgress func()
+
+	sources  []Source
+	srcState sourceState
+	pruned   []string
+	queue    *workQueue
+	// cached are the -cache entries to re-validate, reuse those that
+	// -skip-cached passes on as they are.
+	cached, reuse []result
+	st            stats
+
+	raw   chan candidate
+	jobs  chan candidate
+	valid chan result
+	// Weighted sources wait in wq rather than in jobs' buffer, and jobs is
+	// unbuffered so the weights pick each candidate as a worker frees up.
+	weights map[string]int
+	wq      *weightedQueue
+
+	seen   candidateSet
+	bloom  *bloomSet
+	seeds  *seedPhase
+	vcache *validationCache
+	// vcacheHits passes replayed results on to deliver, once it exists.
+	vcacheHits chan []result
+	limit      *concurrencyLimit
+	// onResult, when set, receives every validation result as soon as its
+	// checks finish, with valid reporting whether the proxy is kept. It is
+	// for programs embedding the pipeline; the CLI leaves it nil. It is
+	// called concurrently from the validation workers (on the workers in a
+	// distributed run), so it must be safe for concurrent use, and it runs
+	// on the worker's time: a slow callback slows validation. Tags and Caps
+	// share storage with the result passed on to the output, so copy them
+	// before modifying.
+	onResult func(res result, valid bool)
+	vwg      sync.WaitGroup
+
+	// deliver's state: a proxy validating again, under another protocol
+	// hint, isn't counted twice.
+	deliverMu  sync.Mutex
+	delivered  map[string]bool // proxy -> first result passed on
+	portCounts map[string]int
+	portCapped int
+	// portHeld keeps the results over the cap for the validation cache,
+	// which replays them to runs with another cap.
+	portHeld   []result
+	validCount int64
+
+	// Set by collect and filter for the outputs and the summary.
+	merged          map[string]result
+	timedOut        bool
+	reused          int
+	stillValid      int
+	out             []string
+	subnets         map[string]int
+	subnetRejected  int
+	partialCaps     int
+	multiPort       []multiPortHost
+	countryRejected int
+	everSeen        map[string]struct{}
+	revalidated     bool
+	fast, slow      []string
+	byProto         map[string][]string
+}
+
+// newRun loads what the flags point at and builds the run's components.
+// The anonymity judge, -judge and -dns are contacted here, so a bad endpoint
+// fails the run before any source is fetched.
+func newRun(cfg *config) (*run, error) {
+	r := &run{
+		cfg:        cfg,
+		ex:         &extractor{patterns: cfg.patterns, transforms: cfg.transforms.fns},
+		countries:  make(map[string]bool),
+		delivered:  make(map[string]bool),
+		portCounts: make(map[string]int),
+	}
+
+	if cfg.frontConnect != "" {
+		r.front = &frontCheck{connect: cfg.frontConnect, sni: cfg.frontSNI, httpHost: cfg.frontHost}
+	}
+
+	if cfg.headerEcho != "" {
+		var err error
+		if r.headerReq, err = parseProbeRequest("GET " + cfg.headerEcho + "|" + cfg.headerTest); err != nil {
+			return nil, fmt.Errorf("invalid -header-echo-url or -header-test: %w", err)
+		}
+	}
+
+	if cfg.anonymity != "" {
+		min := cfg.anonymity
+		if min == "all" {
+			min = ""
+		}
+		// Through -via-socks, proxies see connections from the gateway, so
+		// that's the address a transparent one gives away.
+		var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+		if cfg.viaSOCKS != "" {
+			dial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialVia(ctx, cfg.viaSOCKS, addr, cfg.dialTimeout)
+			}
+		}
+		var err error
+		if r.anon, err = newAnonymityCheck(cfg.anonJudge, min, cfg.httpTimeout, dial); err != nil {
+			return nil, fmt.Errorf("anonymity judge failed: %w", err)
+		}
+	}
+
+	if cfg.revalidate != "" {
+		var err error
+		if r.recheck, err = loadProxyFile(cfg.revalidate); err != nil {
+			return nil, fmt.Errorf("failed to load revalidate list: %w", err)
+		}
+		if len(r.recheck) == 0 {
+			return nil, errors.New("revalidate list contains no proxies")
+		}
+		outSet, schemeSet := false, false
+		flag.Visit(func(f *flag.Flag) {
+			outSet = outSet || f.Name == "out"
+			schemeSet = schemeSet || f.Name == "with-scheme"
+		})
+		if !outSet {
+			cfg.outFile = cfg.revalidate
+		}
+		// A list written with -with-scheme keeps its schemes.
+		for _, c := range r.recheck {
+			if !schemeSet && c.Protocol != "" {
+				cfg.withScheme = true
+				break
+			}
+		}
+	}
+
+	var err error
+	if r.v, err = newValidator(cfg); err != nil {
+		return nil, err
+	}
+
+	var asns *asnDB
+	if cfg.asnDBPath != "" {
+		if asns, err = loadASNDB(cfg.asnDBPath); err != nil {
+			return nil, fmt.Errorf("failed to load ASN database: %w", err)
+		}
+	}
+	if cfg.geoIPPath != "" {
+		if r.geo, err = loadGeoDB(cfg.geoIPPath); err != nil {
+			return nil, fmt.Errorf("failed to load GeoIP database: %w", err)
+		}
+	}
+	for _, c := range strings.Split(cfg.countries, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			r.countries[c] = true
+		}
+	}
+	if len(r.countries) > 0 && r.geo == nil {
+		slog.Warn("-country needs a -geoip database, not filtering by country")
+	}
+
+	if r.outputs, err = newOutputSet(cfg, asns); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// loadSources settles what the run reads: the sources, minus those
+// -prune-sources-below drops, the -queue-dir and -cache state, and the
+// channels of the pipeline.
+func (r *run) loadSources() error {
+	cfg, v := r.cfg, r.v
+	sources := defaultSources
+	if cfg.sourcesFile != "" {
+		custom, err := loadSourcesFile(cfg.sourcesFile)
+		if err != nil {
+			return fmt.Errorf("failed to load sources: %w", err)
+		}
+		if len(custom) > 0 {
+			sources = custom
+		}
+		if cfg.shuffle && sourceWeights(custom) != nil {
+			// A random order would throw away what the weights ask for.
+			return errors.New("-shuffle cannot be combined with weighted sources")
+		}
+	}
+	if deduped, dropped := dedupSources(sources); dropped > 0 {
+		slog.Info("dropped duplicate source URLs", "count", dropped)
+		sources = deduped
+	}
+
+	if cfg.stdinMode || cfg.role == "worker" || cfg.revalidate != "" {
+		sources = nil
+	}
+	// An explicit -mode applies to every source without a declared
+	// protocol; otherwise names like "TheSpeedX-http" pick the mode.
+	modeSet := false
+	flag.Visit(func(f *flag.Flag) { modeSet = modeSet || f.Name == "mode" })
+	if !modeSet {
+		hinted := make([]Source, len(sources))
+		for i, src := range sources {
+			if src.Protocol == "" {
+				src.Protocol = protocolFromName(src.Name)
+			}
+			hinted[i] = src
+		}
+		sources = hinted
+	}
+	for _, src := range sources {
+		if src.Protocol != "socks4" || v.testIP4 != nil {
+			continue
+		}
+		// SOCKS4 wasn't resolved for at startup.
+		if v.testIP4 = v.resolveIPv4(v.testHost); v.testIP4 == nil {
+			slog.Warn("test host has no IPv4 address, SOCKS4 validation disabled", "host", v.testHost)
+		}
+		for i := range v.hosts {
+			v.hosts[i].testIP4 = v.resolveIPv4(v.hosts[i].host)
+		}
+		break
+	}
+
+	if cfg.sourceStateFile != "" {
+		var err error
+		if r.srcState, err = loadSourceState(cfg.sourceStateFile); err != nil {
+			return fmt.Errorf("failed to load source stats: %w", err)
+		}
+		if cfg.pruneBelow > 0 {
+			sources, r.pruned = r.srcState.prune(sources, cfg.pruneBelow)
+			for _, p := range r.pruned {
+				slog.Info("pruned source", "source", p)
+			}
+		}
+	}
+
+	if cfg.queueDir != "" {
+		var err error
+		if r.queue, err = openWorkQueue(cfg.queueDir); err != nil {
+			return fmt.Errorf("failed to open work queue: %w", err)
+		}
+		if r.queue.resumed() {
+			slog.Info("resuming work queue", "dir", cfg.queueDir,
+				"left", len(r.queue.pending), "queued", len(r.queue.queued), "valid", len(r.queue.results))
+		}
+		if r.queue.fetched {
+			sources = nil
+		}
+	}
+	r.sources = sources
+
+	r.raw = make(chan candidate, 20000)
+	r.jobs = make(chan candidate, 20000)
+	r.valid = make(chan result, 20000)
+	if r.weights = sourceWeights(sources); r.weights != nil {
+		r.wq = newWeightedQueue(r.weights)
+		r.jobs = make(chan candidate)
+	}
+
+	r.st = stats{perSource: make(map[string]*sourceStats, len(sources))}
+	for _, src := range sources {
+		r.st.perSource[src.Name] = &sourceStats{}
+	}
+	if cfg.stdinMode {
+		r.st.perSource[stdinSource] = &sourceStats{}
+	}
+	if cfg.revalidate != "" {
+		r.st.perSource[revalidateSource] = &sourceStats{}
+	}
+	if cfg.cacheFile != "" && cfg.role != "worker" {
+		var err error
+		if r.cached, err = loadKnownCache(cfg.cacheFile); err != nil {
+			return fmt.Errorf("failed to load cache: %w", err)
+		}
+		if cfg.skipCached {
+			r.reuse, r.cached = splitFreshCache(r.cached, cfg.cacheMaxAge, time.Now())
+		}
+		r.st.perSource[cacheSource] = &sourceStats{}
+	}
+	return nil
+}
+
+// backlog is the number of candidates waiting for a validation worker.
+func (r *run) backlog() int { return len(r.jobs) + r.wq.len() }
+
+// startFetch starts a fetcher per source, and feeders for -cache, -revalidate
+// and stdin, all sending to raw, which is closed once they are done.
+func (r *run) startFetch() error {
+	cfg, ctx := r.cfg, r.ctx
+	fetchVia := http.ProxyFromEnvironment
+	if cfg.fetchProxy != "" {
+		u, err := parseFetchProxy(cfg.fetchProxy)
+		if err != nil {
+			return fmt.Errorf("invalid -fetch-proxy: %w", err)
+		}
+		fetchVia = http.ProxyURL(u)
+	}
+	transport := &http.Transport{
+		Proxy:                 fetchVia,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          200,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       r.v.tlsBase.Clone(),
+	}
+	client := &http.Client{
+		Timeout:   cfg.httpTimeout,
+		Transport: transport,
+	}
+
+	if cfg.seedMin > 0 {
+		r.seeds = newSeedPhase(r.sources, cfg.seedMin)
+	}
+	seeds := r.seeds
+
+	var fwg, seedWG sync.WaitGroup
+	sem := make(chan struct{}, cfg.fetchers)
+	// hostSems caps fetches per hostname on top of sem. It is filled
+	// before any fetcher starts and only read afterwards.
+	hostSems := make(map[string]chan struct{})
+	if cfg.perHost > 0 {
+		for _, src := range r.sources {
+			if u, err := url.Parse(src.URL); err == nil && hostSems[u.Hostname()] == nil {
+				hostSems[u.Hostname()] = make(chan struct{}, cfg.perHost)
+			}
+		}
+	}
+
+	for _, src := range r.sources {
+		src := src
+		isSeed := seeds != nil && seeds.isSeed(src.Name)
+		fwg.Add(1)
+		if isSeed {
+			seedWG.Add(1)
+		}
+		go func() {
+			defer fwg.Done()
+			if isSeed {
+				defer seedWG.Done()
+			}
+			c := client
+			if seeds != nil && !isSeed {
+				select {
+				case <-seeds.ready:
+				case <-ctx.Done():
+					return
+				}
+				c = seeds.fetchClient(client, transport)
+			}
+			if cfg.fetchJitter > 0 {
+				// Before taking any slot, so a waiting fetcher doesn't
+				// hold one.
+				sleepCtx(ctx, time.Duration(rand.Int63n(int64(cfg.fetchJitter))))
+				if ctx.Err() != nil {
+					return
+				}
+			}
+			// Take the host slot first so a fetcher waiting on a busy host
+			// doesn't hold a global slot.
+			if u, err := url.Parse(src.URL); err == nil && hostSems[u.Hostname()] != nil {
+				hs := hostSems[u.Hostname()]
+				select {
+				case hs <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				defer func() { <-hs }()
+			}
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+			fetchList(ctx, c, src, r.raw, &r.st, cfg.userAgent, cfg.fetchRetries, r.ex)
+		}()
+	}
+
+	if len(r.cached) > 0 {
+		// Known proxies are re-validated with the protocol that worked
+		// last time.
+		fwg.Add(1)
+		go func() {
+			defer fwg.Done()
+			for _, res := range r.cached {
+				atomic.AddUint64(&r.st.found, 1)
+				atomic.AddUint64(&r.st.source(cacheSource).found, 1)
+				proto := normalizeMode(res.Protocol)
+				if res.Protocol == "https" {
+					// An HTTPS proxy, not the hint alias for CONNECT.
+					proto = "https"
+				}
+				select {
+				case r.raw <- candidate{Addr: res.Proxy, Source: cacheSource, Protocol: proto}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if len(r.recheck) > 0 {
+		fwg.Add(1)
+		go func() {
+			defer fwg.Done()
+			for _, c := range r.recheck {
+				atomic.AddUint64(&r.st.found, 1)
+				atomic.AddUint64(&r.st.source(revalidateSource).found, 1)
+				c.Source = revalidateSource
+				select {
+				case r.raw <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if cfg.stdinMode && cfg.role != "worker" && (r.queue == nil || !r.queue.fetched) {
+		fwg.Add(1)
+		go func() {
+			defer fwg.Done()
+			if err := readCandidates(ctx, os.Stdin, r.raw, &r.st, r.ex); err != nil && ctx.Err() == nil {
+				slog.Warn("reading stdin failed", "error", err)
+			}
+		}()
+	}
+
+	if seeds != nil {
+		// The zero candidate marks the end of seed input for the dedup stage.
+		fwg.Add(1)
+		go func() {
+			defer fwg.Done()
+			seedWG.Wait()
+			select {
+			case r.raw <- candidate{}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	go func() {
+		fwg.Wait()
+		close(r.raw)
+	}()
+	return nil
+}
+
+// startDedup passes each candidate from raw on to jobs the first time it is
+// seen, after resumed -queue-dir candidates. With a validation cache or
+// -shuffle the whole candidate set has to be known before anything is
+// validated, so candidates are held back until raw is closed.
+func (r *run) startDedup() {
+	cfg, ctx, st := r.cfg, r.ctx, &r.st
+	r.seen = &exactSet{}
+	if cfg.bloomN > 0 {
+		r.bloom = newBloomSet(cfg.bloomN, cfg.bloomFP)
+		r.seen = r.bloom
+	}
+	if r.queue != nil {
+		r.queue.seenKeys(func(key string) { r.seen.add(key) })
+	}
+	for _, res := range r.reuse {
+		r.seen.add(candidate{Addr: res.Proxy}.dedupKey())
+	}
+
+	if cfg.vcacheDir != "" {
+		r.vcache = &validationCache{dir: cfg.vcacheDir, fingerprint: r.v.fingerprint() + "\n" + flagFingerprint(verdictFlags)}
+	}
+	r.vcacheHits = make(chan []result, 1)
+
+	queue, seeds, vcache, wq := r.queue, r.seeds, r.vcache, r.wq
+	go func() {
+		defer close(r.jobs)
+		defer close(r.vcacheHits)
+		var (
+			held   []candidate
+			heldMu sync.Mutex
+		)
+		if queue != nil {
+			for _, c := range queue.pending {
+				atomic.AddUint64(&st.enqueued, 1)
+				atomic.AddUint64(&st.source(c.Source).enqueued, 1)
+				select {
+				case r.jobs <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		var drained <-chan struct{}
+		if wq != nil {
+			drained = wq.drain(ctx, r.jobs)
+		}
+		var dwg sync.WaitGroup
+		for i := 0; i < cfg.dedupWorkers; i++ {
+			dwg.Add(1)
+			go func() {
+				defer dwg.Done()
+				for c := range r.raw {
+					if c.Addr == "" {
+						seeds.queued()
+						continue
+					}
+					if !r.seen.add(c.dedupKey()) {
+						continue
+					}
+					atomic.AddUint64(&st.enqueued, 1)
+					atomic.AddUint64(&st.source(c.Source).enqueued, 1)
+					if seeds != nil && seeds.isSeed(c.Source) {
+						seeds.add()
+					}
+					if vcache != nil || cfg.shuffle {
+						heldMu.Lock()
+						held = append(held, c)
+						heldMu.Unlock()
+						continue
+					}
+					if queue != nil {
+						if err := queue.push(&c); err != nil {
+							slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+						}
+					}
+					if wq != nil {
+						wq.push(c)
+						continue
+					}
+
+					select {
+					case r.jobs <- c:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+		}
+		dwg.Wait()
+		if wq != nil {
+			wq.close()
+			<-drained
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		markFetched := func() {
+			if queue != nil {
+				if err := queue.markFetched(); err != nil {
+					slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+				}
+			}
+		}
+		if vcache == nil && !cfg.shuffle {
+			markFetched()
+			return
+		}
+
+		if cfg.shuffle {
+			seed := cfg.shuffleSeed
+			if seed == 0 {
+				seed = time.Now().UnixNano()
+			}
+			rng := rand.New(rand.NewSource(seed))
+			rng.Shuffle(len(held), func(i, j int) { held[i], held[j] = held[j], held[i] })
+		}
+		if r.weights != nil {
+			held = weightedOrder(held, r.weights)
+		}
+		// Held candidates go into the queue log before it is marked
+		// fetched: a run interrupted in between then fetches again on
+		// resume instead of skipping the sources and losing them.
+		if queue != nil {
+			for i := range held {
+				if err := queue.push(&held[i]); err != nil {
+					slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+				}
+			}
+		}
+		markFetched()
+
+		if vcache != nil {
+			if cached, ok := vcache.lookup(held); ok {
+				for _, c := range held {
+					atomic.AddUint64(&st.source(c.Source).checked, 1)
+				}
+				r.vcacheHits <- cached
+				return
+			}
+		}
+		for _, c := range held {
+			select {
+			case r.jobs <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// setupChecks prepares what validation needs beyond the validator: the DNS
+// leak test and -auto-tune's concurrency limit.
+func (r *run) setupChecks() error {
+	cfg := r.cfg
+	if cfg.autoTune {
+		r.v.dials = &dialCounters{}
+		r.limit = newConcurrencyLimit(cfg.workers)
+		go autoTune(r.ctx, r.limit, r.v.dials, cfg.workers, time.Second)
+	}
+	if cfg.leakZone != "" {
+		var err error
+		if r.leaks, err = newDNSLeakCheck(cfg.leakZone, cfg.leakAPI, cfg.dialTimeout, cfg.rwTimeout); err != nil {
+			return fmt.Errorf("dns leak test setup failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// probe runs every test on one candidate and reports whether it should be
+// kept.
+func (r *run) probe(c candidate) (result, bool) {
+	cfg, ctx, v, st := r.cfg, r.ctx, r.v, &r.st
+	p := c.Addr
+	if r.limit != nil {
+		r.limit.acquire()
+	}
+	// Credentials are only offered to candidates the user vouched for.
+	pv, auth := v, v.socksAuth
+	if auth != nil && !c.Auth {
+		anon := *v
+		anon.socksAuth = nil
+		pv, auth = &anon, nil
+	}
+	var (
+		res result
+		ok  bool
+	)
+	if cfg.backoff > 0 {
+		res, ok = pv.validateBackoff(p, c.Protocol, cfg.backoff, cfg.backoffTries)
+	} else {
+		res, ok = pv.validate(p, c.Protocol)
+	}
+	if r.limit != nil {
+		r.limit.release()
+	}
+	res.Source = c.Source
+	slow := ok && cfg.maxLatency > 0 && res.Latency > cfg.maxLatency
+	if r.seeds != nil && r.seeds.isSeed(c.Source) {
+		r.seeds.finish(p, res.Protocol, ok && !slow)
+	}
+	if !ok {
+		res.Reject = "probe failed"
+		return res, false
+	}
+	if slow {
+		atomic.AddUint64(&st.tooSlow, 1)
+		res.Reject = "slower than -max-latency"
+		return res, false
+	}
+	if cfg.requireFull {
+		// Record the other capability too for the post-validation
+		// filter.
+		res.Caps = []string{res.Protocol}
+		other := map[string]string{"http": "connect", "connect": "http"}[res.Protocol]
+		if other != "" {
+			if _, ok := v.validate(p, other); ok {
+				res.Caps = append(res.Caps, other)
+			}
+		}
+	}
+	if res.Timeout > 0 {
+		atomic.AddUint64(&st.slowOK, 1)
+	}
+	if cfg.largeURL != "" && res.Protocol == "http" {
+		// The fetch is an absolute-form GET, which says nothing about
+		// how a tunnel handles large responses.
+		if !v.budget.take() {
+			res.Reject = "connection budget exhausted"
+			return res, false
+		}
+		atomic.AddUint64(&st.largeRun, 1)
+		if !checkLargeResponse(ctx, p, cfg.largeURL, cfg.largeMax, cfg.dialTimeout, cfg.largeTimeout) {
+			if ctx.Err() != nil {
+				// Cut short by the run ending, not by the proxy.
+				return res, false
+			}
+			res.Tags = append(res.Tags, "unreliable")
+			atomic.AddUint64(&st.truncated, 1)
+			if cfg.dropTrunc {
+				res.Reject = "large response truncated"
+				return res, false
+			}
+		}
+	}
+
+	if r.front != nil {
+		if res.Protocol != "connect" || !v.checkFronting(p, r.front) {
+			res.Reject = "domain fronting failed"
+			return res, false
+		}
+		res.Tags = append(res.Tags, "fronting")
+		res.FrontConnect, res.FrontSNI = r.front.connect, r.front.sni
+	}
+
+	if r.headerReq != nil && res.Protocol == "http" {
+		if preserved, ok := v.checkHeaders(p, r.headerReq); ok {
+			if preserved {
+				res.Tags = append(res.Tags, "headers-preserved")
+				atomic.AddUint64(&st.headersOK, 1)
+			} else {
+				res.Tags = append(res.Tags, "headers-stripped")
+			}
+		}
+	}
+
+	if r.anon != nil && res.Protocol == "http" {
+		// Tunnelling protocols relay the client's bytes untouched and
+		// aren't classified.
+		level, ok := v.checkAnonymity(p, r.anon)
+		if ok {
+			res.Anonymity = level
+		}
+		if !ok && r.anon.min != "" || ok && !r.anon.keep(level) {
+			atomic.AddUint64(&st.anonDrop, 1)
+			res.Reject = "anonymity below -anonymity"
+			return res, false
+		}
+	}
+
+	if cfg.cacheBust && res.Protocol == "http" {
+		if caching, ok := v.checkCaching(p); ok && caching {
+			res.Tags = append(res.Tags, "caching")
+			atomic.AddUint64(&st.caching, 1)
+			if cfg.dropCaching {
+				res.Reject = "caching proxy"
+				return res, false
+			}
+		}
+	}
+
+	if cfg.socksUDP && v.budget.take() && checkSOCKS5UDP(ctx, p, cfg.udpResolver, v.testHost, auth, cfg.dialTimeout, cfg.rwTimeout) {
+		res.Tags = append(res.Tags, "socks5-udp-verified")
+		atomic.AddUint64(&st.udpOK, 1)
+	}
+
+	if r.leaks != nil && v.budget.take() {
+		if leak, ok := r.leaks.check(ctx, p, res.Protocol, auth); ok {
+			res.DNSLeak = &leak
+			if leak {
+				res.Tags = append(res.Tags, "dns-leak")
+				atomic.AddUint64(&st.dnsLeaks, 1)
+			}
+		}
+	}
+	return res, true
+}
+
+// check probes one candidate, keeping the in-flight and per-source counts
+// and logging the verdict.
+func (r *run) check(c candidate) (result, bool) {
+	st := &r.st
+	atomic.AddInt64(&st.inFlight, 1)
+	res, ok := r.probe(c)
+	atomic.AddInt64(&st.inFlight, -1)
+	if r.onResult != nil {
+		r.onResult(res, ok)
+	}
+	if ok || r.ctx.Err() == nil {
+		atomic.AddUint64(&st.source(c.Source).checked, 1)
+	}
+	if ok {
+		slog.Debug("proxy validated", "proxy", res.Proxy, "protocol", res.Protocol, "latency_ms", res.Latency.Milliseconds(), "source", res.Source)
+	} else {
+		slog.Debug("proxy rejected", "proxy", c.Addr, "source", c.Source, "reason", res.Reject)
+	}
+	if ok && r.cfg.verbose && len(res.TestHosts) > 0 {
+		slog.Info("proxy passed", "proxy", res.Proxy, "test_hosts", strings.Join(res.TestHosts, ","))
+	}
+	return res, ok
+}
+
+// deliver counts a valid result and hands it to collect. It reports false
+// once the run is over. A proxy validating again, under another protocol
+// hint, isn't counted twice: the repeat only goes on to collect for
+// -merge-strategy, and only if the first result did.
+func (r *run) deliver(res result) bool {
+	cfg, st := r.cfg, &r.st
+	r.deliverMu.Lock()
+	passed, repeat := r.delivered[res.Proxy]
+	if !repeat {
+		atomic.AddUint64(&st.valid, 1)
+		atomic.AddUint64(&st.source(res.Source).valid, 1)
+		passed = true
+		if cfg.maxPerPort > 0 {
+			_, port, _ := net.SplitHostPort(res.Proxy)
+			if r.portCounts[port] >= cfg.maxPerPort {
+				r.portCapped++
+				passed = false
+				if r.vcache != nil {
+					r.portHeld = append(r.portHeld, res)
+				}
+			} else {
+				r.portCounts[port]++
+			}
+		}
+		r.delivered[res.Proxy] = passed
+	}
+	r.deliverMu.Unlock()
+	if !passed {
+		return true
+	}
+	var newCount int64
+	if !repeat {
+		newCount = atomic.AddInt64(&r.validCount, 1)
+	}
+
+	select {
+	case r.valid <- res:
+	case <-r.ctx.Done():
+		return false
+	}
+
+	if !repeat && cfg.maxValid > 0 && int(newCount) >= cfg.maxValid {
+		r.cancel()
+		return false
+	}
+	return true
+}
+
+// startValidation starts whatever turns jobs into results for deliver:
+// validation workers, the coordinator or the -no-validate pass-through, plus
+// the replay of cached results. valid is closed once they are all done.
+func (r *run) startValidation() {
+	cfg, ctx := r.cfg, r.ctx
+	if r.vcache != nil {
+		// Replayed results go through deliver like fresh ones.
+		r.vwg.Add(1)
+		go func() {
+			defer r.vwg.Done()
+			for _, res := range <-r.vcacheHits {
+				if !r.deliver(res) {
+					return
+				}
+			}
+		}()
+	}
+
+	if len(r.reuse) > 0 {
+		// Reused results count like fresh ones, so -max, -max-per-port
+		// and -stream see them.
+		r.vwg.Add(1)
+		go func() {
+			defer r.vwg.Done()
+			for _, res := range r.reuse {
+				res.Source = cacheSource
+				atomic.AddUint64(&r.st.source(cacheSource).checked, 1)
+				if !r.deliver(res) {
+					return
+				}
+			}
+		}()
+	}
+
+	if cfg.role == "coordinator" {
+		r.vwg.Add(1)
+		go func() {
+			defer r.vwg.Done()
+			checked := func(c candidate) { atomic.AddUint64(&r.st.source(c.Source).checked, 1) }
+			if err := serveCoordinator(ctx, cfg.listenAddr, cfg.distToken, cfg.leaseTimeout, r.jobs, r.deliver, checked); err != nil {
+				slog.Error("coordinator failed", "error", err)
+				r.cancel()
+			}
+		}()
+	}
+
+	if cfg.noValidate {
+		r.vwg.Add(1)
+		go func() {
+			defer r.vwg.Done()
+			for c := range r.jobs {
+				res := result{Proxy: c.Addr, Protocol: c.Protocol, Source: c.Source}
+				if !r.deliver(res) {
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; cfg.role == "" && !cfg.noValidate && i < cfg.workers; i++ {
+		r.vwg.Add(1)
+		go func() {
+			defer r.vwg.Done()
+			for c := range r.jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				res, ok := r.check(c)
+				if r.queue != nil {
+					// A check cut short by the deadline is redone on resume.
+					if ctx.Err() != nil {
+						return
+					}
+					if ok {
+						if err := r.queue.result(res); err != nil {
+							slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+						}
+					}
+					if err := r.queue.done(c.seq); err != nil {
+						slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+					}
+				}
+				if ok && !r.deliver(res) {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		r.vwg.Wait()
+		close(r.valid)
+	}()
+}
+
+// collect merges the valid results as they arrive, streaming them with
+// -stream, and once validation is over stores the state later runs pick up:
+// the work queue, the validation cache and the -cache file.
+func (r *run) collect() error {
+	cfg, ctx := r.cfg, r.ctx
+	var stream *streamWriter
+	if cfg.streamOut {
+		var err error
+		if stream, err = openStream(r.outputs.main, cfg.appendOut); err != nil {
+			return fmt.Errorf("failed opening output for streaming: %w", err)
+		}
+	}
+
+	merged := make(map[string]result)
+	if r.queue != nil {
+		for _, res := range r.queue.results {
+			atomic.AddUint64(&r.st.valid, 1)
+			atomic.AddUint64(&r.st.source(res.Source).checked, 1)
+			atomic.AddUint64(&r.st.source(res.Source).valid, 1)
+			mergeResult(merged, res, cfg.mergeMode)
+			if stream != nil {
+				stream.add(res)
+			}
+		}
+	}
+	for res := range r.valid {
+		mergeResult(merged, res, cfg.mergeMode)
+		if stream != nil {
+			stream.add(res)
+		}
+	}
+	r.merged = merged
+	r.stopProgress()
+	// Checked as soon as validation ends, so time spent writing output
+	// doesn't count.
+	r.timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if stream != nil {
+		if err := stream.close(); err != nil {
+			slog.Error("streaming output failed", "error", err)
+		}
+		if cfg.appendOut {
+			// The streamed lines are the output.
+			var rest []outputTarget
+			for _, t := range r.outputs.main {
+				if !streamable(t) {
+					rest = append(rest, t)
+				}
+			}
+			r.outputs.main = rest
+		}
+	}
+	if r.queue != nil {
+		complete := ctx.Err() == nil || (cfg.maxValid > 0 && int(r.validCount) >= cfg.maxValid)
+		if err := r.queue.close(complete); err != nil {
+			slog.Warn("work queue write failed", "dir", cfg.queueDir, "error", err)
+		}
+	}
+	if r.vcache != nil {
+		switch {
+		case r.vcache.hit:
+			slog.Info("validation cache hit, reusing results", "key", r.vcache.key[:12])
+		case ctx.Err() == nil:
+			// Only complete runs are worth replaying. Results held back by
+			// -max-per-port are stored too; the cap applies again on
+			// replay.
+			all := make(map[string]result, len(merged)+len(r.portHeld))
+			for p, res := range merged {
+				all[p] = res
+			}
+			for _, res := range r.portHeld {
+				mergeResult(all, res, cfg.mergeMode)
+			}
+			if err := r.vcache.store(all); err != nil {
+				slog.Warn("validation cache write failed", "dir", cfg.vcacheDir, "error", err)
+			}
+		}
+	}
+
+	for _, res := range r.cached {
+		if _, ok := merged[res.Proxy]; ok {
+			r.stillValid++
+		}
+	}
+	for _, res := range r.reuse {
+		if _, ok := merged[res.Proxy]; ok {
+			r.reused++
+		}
+	}
+	if cfg.cacheFile != "" {
+		// Reused entries were never re-checked, so they stay whether or
+		// not they made it into this run's output.
+		save := make(map[string]result, len(merged)+len(r.reuse))
+		for _, res := range r.reuse {
+			save[res.Proxy] = res
+		}
+		if ctx.Err() != nil {
+			// A run that ended early, interrupted or stopped by -max, may
+			// not have re-validated every cached proxy yet; keep the ones
+			// it didn't get to.
+			for _, res := range r.cached {
+				save[res.Proxy] = res
+			}
+		}
+		for p, res := range merged {
+			save[p] = res
+		}
+		if err := saveKnownCache(cfg.cacheFile, save); err != nil {
+			slog.Warn("cache write failed", "path", cfg.cacheFile, "error", err)
+		}
+	}
+	return nil
+}
+
+// filter applies the output filters to the merged results and leaves the
+// sorted list to write in out.
+func (r *run) filter() error {
+	cfg, merged := r.cfg, r.merged
+	if cfg.requireFull {
+		r.partialCaps = requireFull(merged)
+	}
+	if cfg.multiPortN > 0 {
+		r.multiPort = flagMultiPort(merged, cfg.multiPortN, cfg.dropMulti)
+	}
+	if r.geo != nil {
+		for p, res := range merged {
+			res.Country = r.geo.country(p)
+			merged[p] = res
+		}
+		if len(r.countries) > 0 {
+			r.countryRejected = filterCountries(merged, r.countries)
+		}
+	}
+	if cfg.diverse {
+		r.subnets, r.subnetRejected = diversify(merged, cfg.perSubnet)
+	}
+
+	out := make([]string, 0, len(merged))
+	for p := range merged {
+		out = append(out, p)
+	}
+	var byLatency func(a, b string) int
+	if cfg.sortBy == "latency" {
+		byLatency = func(a, b string) int {
+			switch la, lb := merged[a].Latency, merged[b].Latency; {
+			case la < lb:
+				return -1
+			case la > lb:
+				return 1
+			}
+			return 0
+		}
+	}
+	sortProxies(out, byLatency)
+
+	if cfg.seenEver != "" {
+		var err error
+		if r.everSeen, err = loadSeenStore(cfg.seenEver); err != nil {
+			return fmt.Errorf("failed to load seen-ever store: %w", err)
+		}
+		if cfg.firstSeen {
+			out = filterUnseen(out, r.everSeen)
+		}
+	}
+	r.out = out
+	return nil
+}
+
+// writeOutputs writes out to -out, the latency tiers and the protocol lists,
+// then records it in the -seen-ever store.
+func (r *run) writeOutputs() error {
+	cfg, out, merged := r.cfg, r.out, r.merged
+	r.revalidated = cfg.revalidate != "" && r.ctx.Err() == nil
+	if cfg.revalidate != "" && !r.revalidated {
+		// Entries that were never checked would be pruned as dead.
+		slog.Warn("revalidation did not finish, leaving the list untouched", "path", cfg.outFile)
+	} else if len(out) == 0 && cfg.keepOnEmpty {
+		slog.Warn("no valid proxies, leaving the output untouched", "path", cfg.outFile)
+	} else if err := writeOutput(r.outputs.main, out, merged, cfg.writeRetries); err != nil {
+		return fmt.Errorf("failed writing output: %w", err)
+	}
+	r.fast, r.slow = splitByLatency(out, merged, cfg.fastCutoff)
+	for _, tier := range []struct {
+		targets []outputTarget
+		list    []string
+	}{{r.outputs.fast, r.fast}, {r.outputs.slow, r.slow}} {
+		if len(tier.targets) == 0 || len(tier.list) == 0 && cfg.keepOnEmpty {
+			continue
+		}
+		if err := writeOutput(tier.targets, tier.list, merged, cfg.writeRetries); err != nil {
+			return fmt.Errorf("failed writing output: %w", err)
+		}
+	}
+	r.byProto = splitByProtocol(out, merged)
+	for _, proto := range outputProtocols {
+		targets := r.outputs.proto[proto]
+		if len(targets) == 0 || len(r.byProto[proto]) == 0 && cfg.keepOnEmpty {
+			continue
+		}
+		if err := writeOutput(targets, r.byProto[proto], merged, cfg.writeRetries); err != nil {
+			return fmt.Errorf("failed writing output: %w", err)
+		}
+	}
+
+	if cfg.seenEver != "" {
+		if err := updateSeenStore(cfg.seenEver, r.everSeen, out); err != nil {
+			return fmt.Errorf("failed updating seen-ever store: %w", err)
+		}
+	}
+	return nil
+}
+
+// printSummary prints the run's counters and a line for each check or
+// filter that was on.
+func (r *run) printSummary() {
+	cfg, st, merged := r.cfg, &r.st, r.merged
+	fmt.Printf("Done.\n")
+	if cfg.noValidate {
+		fmt.Println("Validation skipped (-no-validate): valid and wrote count unique candidates")
+	}
+	fmt.Printf("Sources: %d | fetched_ok: %d | lines: %d | found: %d | enqueued: %d | valid: %d | wrote: %d\n",
+		len(r.sources),
+		atomic.LoadUint64(&st.fetchedOK),
+		atomic.LoadUint64(&st.linesRead),
+		atomic.LoadUint64(&st.found),
+		atomic.LoadUint64(&st.enqueued),
+		atomic.LoadUint64(&st.valid),
+		len(r.out),
+	)
+	if !cfg.noValidate {
+		fmt.Printf("Protocols: %s\n", protocolSummary(merged, cfg.labels))
+	}
+	if len(r.outputs.fast)+len(r.outputs.slow) > 0 {
+		fmt.Printf("Tiers: fast (<%s): %d | slow: %d\n", cfg.fastCutoff, len(r.fast), len(r.slow))
+	}
+	if len(r.outputs.proto) > 0 {
+		var parts []string
+		for _, proto := range outputProtocols {
+			if len(r.outputs.proto[proto]) > 0 {
+				parts = append(parts, fmt.Sprintf("%s: %d", proto, len(r.byProto[proto])))
+			}
+		}
+		fmt.Printf("Protocol outputs: %s\n", strings.Join(parts, " | "))
+	}
+	if slow := timedOutSources(st); len(slow) > 0 {
+		fmt.Printf("Timed out sources (over -http-timeout %s): %s\n", cfg.httpTimeout, strings.Join(slow, ", "))
+	}
+	if r.bloom != nil {
+		fmt.Printf("Dedup: bloom filter of %d KiB for %d candidates at a %g false-positive rate", (r.bloom.bytes()+1023)/1024, cfg.bloomN, cfg.bloomFP)
+		if r.bloom.overCapacity() {
+			fmt.Print(" (over capacity, so more false positives: raise -bloom)")
+		}
+		fmt.Println()
+	}
+	if len(r.pruned) > 0 {
+		fmt.Printf("Pruned sources (below %.2f%% valid): %s\n", 100*cfg.pruneBelow, strings.Join(r.pruned, ", "))
+	}
+	if cfg.diverse {
+		busiest := 0
+		for _, n := range r.subnets {
+			if n > busiest {
+				busiest = n
+			}
+		}
+		fmt.Printf("Subnets: %d distinct | max per subnet: %d | rejected as over-represented: %d\n",
+			len(r.subnets), busiest, r.subnetRejected)
+	}
+	if cfg.multiPortN > 0 {
+		action := "tagged multiport"
+		if cfg.dropMulti {
+			action = "dropped"
+		}
+		fmt.Printf("Multi-port IPs (more than %d validated ports): %d, %s\n", cfg.multiPortN, len(r.multiPort), action)
+		for i, h := range r.multiPort {
+			if i == multiPortListed {
+				fmt.Printf("  ... and %d more (see -report)\n", len(r.multiPort)-i)
+				break
+			}
+			fmt.Printf("  %s: %d ports\n", h.host, h.ports)
+		}
+	}
+	if cfg.maxPerPort > 0 {
+		fmt.Printf("Ports: %d distinct | valid but not written (over -max-per-port): %d\n", len(r.portCounts), r.portCapped)
+	}
+	if r.revalidated {
+		fmt.Printf("Revalidate: %d of %d proxies still working | pruned: %d\n", len(r.out), len(r.recheck), len(r.recheck)-len(r.out))
+	}
+	if cfg.cacheFile != "" {
+		if cfg.skipCached {
+			fmt.Printf("Cache: %d proxies reused without re-validation | expired and re-validated: %d, still valid: %d\n", r.reused, len(r.cached), r.stillValid)
+		} else {
+			fmt.Printf("Cache: %d of %d cached proxies still valid\n", r.stillValid, len(r.cached))
+		}
+	}
+	if r.geo != nil {
+		fmt.Printf("Countries: %s", countrySummary(merged))
+		if len(r.countries) > 0 {
+			fmt.Printf(" | rejected: %d", r.countryRejected)
+		}
+		fmt.Println()
+	}
+	if cfg.requireFull {
+		fmt.Printf("Require full: %d proxies rejected for supporting only one of HTTP forwarding and CONNECT\n", r.partialCaps)
+	}
+	if r.v.budget.exhausted() {
+		fmt.Printf("Connection cap: stopped after %d connection attempts (-max-connections)\n", cfg.maxConns)
+	}
+	if cfg.backoff > 0 {
+		fmt.Printf("Timeout backoff: %d valid proxies needed a slower retry\n", atomic.LoadUint64(&st.slowOK))
+	}
+	if cfg.maxLatency > 0 {
+		fmt.Printf("Max latency: %d proxies answered but were slower than %s\n", atomic.LoadUint64(&st.tooSlow), cfg.maxLatency)
+	}
+	if r.headerReq != nil {
+		fmt.Printf("Header check: %d proxies passed the test headers through intact\n", atomic.LoadUint64(&st.headersOK))
+	}
+	if r.anon != nil {
+		levels := make(map[string]int)
+		for _, res := range merged {
+			if res.Anonymity != "" {
+				levels[res.Anonymity]++
+			}
+		}
+		fmt.Printf("Anonymity: elite=%d anonymous=%d transparent=%d | rejected: %d\n",
+			levels[anonElite], levels[anonAnonymous], levels[anonTransparent], atomic.LoadUint64(&st.anonDrop))
+	}
+	if cfg.cacheBust {
+		fmt.Printf("Cache-busting check: %d proxies answered from a cache\n", atomic.LoadUint64(&st.caching))
+	}
+	if r.leaks != nil {
+		fmt.Printf("DNS leak test: %d of %d valid proxies resolved through local resolvers\n",
+			atomic.LoadUint64(&st.dnsLeaks), atomic.LoadUint64(&st.valid))
+	}
+	if cfg.socksUDP {
+		fmt.Printf("SOCKS5 UDP check: %d of %d valid proxies relayed DNS\n",
+			atomic.LoadUint64(&st.udpOK), atomic.LoadUint64(&st.valid))
+	}
+	if r.seeds != nil {
+		if n := r.seeds.poolSize(); n > 0 {
+			fmt.Printf("Seed phase: remaining sources fetched through %d seed proxies\n", n)
+		} else {
+			fmt.Printf("Seed phase: fewer than %d seed proxies validated, remaining sources fetched directly\n", cfg.seedMin)
+		}
+	}
+	if cfg.largeURL != "" {
+		fmt.Printf("Large-response check: %d of %d HTTP proxies checked truncated the response\n",
+			atomic.LoadUint64(&st.truncated), atomic.LoadUint64(&st.largeRun))
+	}
+}
+
+// finish records the run in -source-stats and -report, raises alerts and
+// returns the exit status: 0, or one of the exit codes in report.go.
+func (r *run) finish() (int, error) {
+	cfg, st := r.cfg, &r.st
+	if r.srcState != nil {
+		r.srcState.record(st)
+		if err := r.srcState.save(cfg.sourceStateFile); err != nil {
+			slog.Warn("source stats write failed", "path", cfg.sourceStateFile, "error", err)
+		}
+	}
+
+	rep := &runReport{
+		Time:      time.Now().UTC(),
+		Sources:   len(r.sources),
+		FetchedOK: atomic.LoadUint64(&st.fetchedOK),
+		Lines:     atomic.LoadUint64(&st.linesRead),
+		Found:     atomic.LoadUint64(&st.found),
+		Enqueued:  atomic.LoadUint64(&st.enqueued),
+		Valid:     atomic.LoadUint64(&st.valid),
+		Wrote:     len(r.out),
+		TimedOut:  r.timedOut,
+	}
+	rep.PerSource, rep.FailedSources = sourceReports(r.sources, st)
+	for _, h := range r.multiPort {
+		rep.MultiPort = append(rep.MultiPort, fmt.Sprintf("%s (%d ports)", h.host, h.ports))
+	}
+	var prev *runReport
+	if cfg.reportFile != "" {
+		var err error
+		if prev, err = loadReport(cfg.reportFile); err != nil {
+			slog.Warn("loading the previous report failed, skipping the drop check", "path", cfg.reportFile, "error", err)
+		}
+	}
+	rep.Alerts = checkAlerts(rep, prev, cfg.alertBelow, cfg.alertDrop)
+	for _, a := range rep.Alerts {
+		slog.Error("alert", "alert", a)
+	}
+	if cfg.reportFile != "" {
+		if err := writeReport(cfg.reportFile, rep); err != nil {
+			return 1, fmt.Errorf("failed writing report: %w", err)
+		}
+	}
+	switch {
+	case cfg.failUnder > 0 && rep.Wrote < cfg.failUnder:
+		// Proxies dropped by the output filters don't make up the pool.
+		slog.Error("too few proxies written", "wrote", rep.Wrote, "fail_under", cfg.failUnder)
+		return exitFailUnder, nil
+	case len(rep.Alerts) > 0:
+		return exitAlert, nil
+	case r.timedOut:
+		slog.Error("-total-timeout reached before every candidate was checked", "total_timeout", cfg.totalTimeout)
+		return exitTimeout, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunCheckCallsOnResult(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing answers on the address once the listener is closed.
+	dead := ln.Addr().String()
+	ln.Close()
+
+	var (
+		mu  sync.Mutex
+		got []result
+		ok  []bool
+	)
+	r := &run{
+		cfg: &config{},
+		v:   &validator{mode: "http", testHost: "example.com", dialTimeout: time.Second, rwTimeout: time.Second, probe: defaultProbeRequest("example.com")},
+		ctx: context.Background(),
+		st:  stats{perSource: map[string]*sourceStats{"src": {}}},
+		onResult: func(res result, valid bool) {
+			mu.Lock()
+			got, ok = append(got, res), append(ok, valid)
+			mu.Unlock()
+		},
+	}
+	r.v.ctx = r.ctx
+	if _, valid := r.check(candidate{Addr: dead, Source: "src"}); valid {
+		t.Fatalf("check(%s) passed a closed port", dead)
+	}
+	if len(got) != 1 || ok[0] || got[0].Source != "src" || got[0].Reject != "probe failed" {
+		t.Errorf("onResult got %+v, %v, want one rejected result from src", got, ok)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// seedPhase coordinates the two-phase fetch plan enabled by -seed-threshold.
+// Seed sources are fetched and validated first; the remaining sources wait on
+// ready and are then fetched through the working seed proxies.
+//
+// ready closes once threshold seed proxies have validated, or once every
+// seed candidate has been checked without reaching it, in which case the
+// remaining sources are fetched directly.
+type seedPhase struct {
+	threshold int
+	names     map[string]bool
+	ready     chan struct{}
+
+	mu        sync.Mutex
+	once      sync.Once
+	pending   int
+	allQueued bool
+	pool      []*url.URL
+	used      int
+	client    *http.Client
+}
+
+// newSeedPhase returns nil when no source is marked as seed.
+func newSeedPhase(sources []Source, threshold int) *seedPhase {
+	names := make(map[string]bool)
+	for _, s := range sources {
+		if s.Seed {
+			names[s.Name] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return &seedPhase{threshold: threshold, names: names, ready: make(chan struct{})}
+}
+
+func (s *seedPhase) isSeed(source string) bool { return s.names[source] }
+
+// add records a seed candidate handed to the validators.
+func (s *seedPhase) add() {
+	s.mu.Lock()
+	s.pending++
+	s.mu.Unlock()
+}
+
+// queued records that every seed candidate has been handed to the
+// validators.
+func (s *seedPhase) queued() {
+	s.mu.Lock()
+	s.allQueued = true
+	s.checkLocked()
+	s.mu.Unlock()
+}
+
+// finish records the verdict for a seed candidate and the protocol it
+// validated with. Proxies whose protocol http.Transport can't use don't join
+// the pool.
+func (s *seedPhase) finish(proxy, protocol string, ok bool) {
+	s.mu.Lock()
+	s.pending--
+	if scheme := seedScheme(protocol); ok && scheme != "" {
+		s.pool = append(s.pool, &url.URL{Scheme: scheme, Host: proxy})
+	}
+	s.checkLocked()
+	s.mu.Unlock()
+}
+
+func (s *seedPhase) checkLocked() {
+	if len(s.pool) >= s.threshold || (s.allQueued && s.pending == 0) {
+		s.once.Do(func() { close(s.ready) })
+	}
+}
+
+// fetchClient returns the client for non-seed sources: base routed through
+// the working seed proxies in rotation, or base itself if fewer than
+// threshold validated. It must only be called after ready is closed.
+func (s *seedPhase) fetchClient(base *http.Client, transport *http.Transport) *http.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client
+	}
+	if len(s.pool) < s.threshold {
+		s.client = base
+		return base
+	}
+
+	pool := append([]*url.URL(nil), s.pool...)
+	s.used = len(pool)
+	var n uint64
+	t := transport.Clone()
+	t.Proxy = func(*http.Request) (*url.URL, error) {
+		i := atomic.AddUint64(&n, 1)
+		return pool[i%uint64(len(pool))], nil
+	}
+	s.client = &http.Client{Timeout: base.Timeout, Transport: t}
+	return s.client
+}
+
+// seedScheme is the proxy URL scheme fetches go through a seed proxy
+// validated with protocol by, or empty for SOCKS4, which http.Transport
+// doesn't speak. A CONNECT proxy is an http:// one to the transport, which
+// tunnels HTTPS sources through it.
+func seedScheme(protocol string) string {
+	switch protocol {
+	case "http", "connect":
+		return "http"
+	case "socks5", "https":
+		return protocol
+	}
+	return ""
+}
+
+// poolSize returns how many seed proxies the remaining sources were fetched
+// through.
+func (s *seedPhase) poolSize() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
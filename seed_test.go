@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSeedPoolSchemes(t *testing.T) {
+	s := newSeedPhase([]Source{{Name: "seed", Seed: true}}, 3)
+	for _, c := range []struct{ addr, protocol string }{
+		{"1.1.1.1:80", "http"},
+		{"2.2.2.2:443", "connect"},
+		{"3.3.3.3:1080", "socks4"},
+		{"4.4.4.4:1080", "socks5"},
+	} {
+		s.add()
+		s.finish(c.addr, c.protocol, true)
+	}
+	select {
+	case <-s.ready:
+	default:
+		t.Fatal("ready still open with three usable seed proxies")
+	}
+	client := s.fetchClient(&http.Client{}, &http.Transport{})
+	proxy := client.Transport.(*http.Transport).Proxy
+	var got []string
+	for range s.pool {
+		u, err := proxy(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, u.String())
+	}
+	want := map[string]bool{"http://1.1.1.1:80": true, "http://2.2.2.2:443": true, "socks5://4.4.4.4:1080": true}
+	for _, u := range got {
+		if !want[u] {
+			t.Errorf("fetch proxy %s, want one of %v (SOCKS4 left out)", u, want)
+		}
+		delete(want, u)
+	}
+	if len(want) > 0 {
+		t.Errorf("rotation never used %v", want)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks5Version      = 0x05
+	socks5CmdConnect   = 0x01
+	socks5CmdUDP       = 0x03
+	socks5AtypIPv4     = 0x01
+	socks5AtypDomain   = 0x03
+	socks5AtypIPv6     = 0x04
+	socks5MethodNoAuth = 0x00
+	socks5MethodUser   = 0x02
+)
+
+// socks5Auth is the -socks-user/-socks-pass credential offered with the
+// username/password method (RFC 1929). It is only offered to candidates
+// the user vouched for (see candidate.Auth): a scraped proxy that picks
+// the method would receive the password in the clear.
+type socks5Auth struct {
+	user, pass string
+}
+
+// Validation evidence recorded for SOCKS proxies, which have no status line.
+const (
+	socks5Granted = "SOCKS5 CONNECT granted"
+	socks4Granted = "SOCKS4 request granted"
+)
+
+// socks5Greet negotiates the no-authentication method on conn. With auth
+// set, username/password is offered too and used if the server picks it.
+func socks5Greet(conn net.Conn, auth *socks5Auth) error {
+	greeting := []byte{socks5Version, 1, socks5MethodNoAuth}
+	if auth != nil {
+		greeting = []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUser}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return errors.New("socks5: bad greeting reply")
+	}
+	switch {
+	case resp[1] == socks5MethodNoAuth:
+		return nil
+	case resp[1] == socks5MethodUser && auth != nil:
+		return socks5Login(conn, auth)
+	}
+	return fmt.Errorf("socks5: no offered method accepted (got %#x)", resp[1])
+}
+
+// socks5Login runs the RFC 1929 username/password subnegotiation.
+func socks5Login(conn net.Conn, auth *socks5Auth) error {
+	if len(auth.user) > 255 || len(auth.pass) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	req := []byte{0x01, byte(len(auth.user))}
+	req = append(req, auth.user...)
+	req = append(req, byte(len(auth.pass)))
+	req = append(req, auth.pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != 0x01 {
+		return errors.New("socks5: bad authentication reply")
+	}
+	if resp[1] != 0x00 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// socks5Request sends cmd for host:port and returns the bound address from
+// the server's reply.
+func socks5Request(conn net.Conn, cmd byte, host string, port int) (net.IP, int, error) {
+	req := []byte{socks5Version, cmd, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, 0, errors.New("socks5: host name too long")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, 0, err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, 0, err
+	}
+	if head[0] != socks5Version {
+		return nil, 0, errors.New("socks5: bad reply version")
+	}
+	if head[1] != 0x00 {
+		return nil, 0, fmt.Errorf("socks5: request failed with code %#x", head[1])
+	}
+
+	var addr []byte
+	switch head[3] {
+	case socks5AtypIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5AtypIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5AtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return nil, 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return nil, 0, errors.New("socks5: bad reply address type")
+	}
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return nil, 0, err
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(conn, p[:]); err != nil {
+		return nil, 0, err
+	}
+
+	var ip net.IP
+	if head[3] != socks5AtypDomain {
+		ip = net.IP(addr)
+	}
+	return ip, int(binary.BigEndian.Uint16(p[:])), nil
+}
+
+// dialVia connects to addr through the upstream SOCKS5 proxy at via. The
+// returned connection is the tunnel, ready for the proxy protocol under
+// test. timeout covers both the dial and the upstream handshake.
+func dialVia(ctx context.Context, via, addr string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", via)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := socks5Greet(conn, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, _, err := socks5Request(conn, socks5CmdConnect, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// checkUpstreamSOCKS reports why the -via-socks proxy at via can't be used,
+// so a dead gateway stops the run instead of failing every candidate.
+func checkUpstreamSOCKS(via string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", via, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	return socks5Greet(conn, nil)
+}
+
+// checkSOCKS5UDP proves the proxy's UDP relay works by sending a DNS query
+// for qname to resolver through a UDP ASSOCIATE and checking for a matching
+// answer. The check is cut short when ctx ends.
+func checkSOCKS5UDP(ctx context.Context, proxyAddr, resolver, qname string, auth *socks5Auth, dialTimeout, rwTimeout time.Duration) bool {
+	ctrl, err := dialPostCheck(ctx, "tcp", proxyAddr, dialTimeout)
+	if err != nil {
+		return false
+	}
+	// The relay only lives as long as the control connection.
+	defer ctrl.Close()
+
+	_ = ctrl.SetDeadline(time.Now().Add(rwTimeout))
+
+	if err := socks5Greet(ctrl, auth); err != nil {
+		return false
+	}
+	relayIP, relayPort, err := socks5Request(ctrl, socks5CmdUDP, "0.0.0.0", 0)
+	if err != nil {
+		return false
+	}
+	if relayIP == nil || relayIP.IsUnspecified() {
+		host, _, _ := net.SplitHostPort(proxyAddr)
+		relayIP = net.ParseIP(host)
+	}
+
+	resHost, resPortStr, err := net.SplitHostPort(resolver)
+	if err != nil {
+		return false
+	}
+	resIP := net.ParseIP(resHost).To4()
+	resPort, err := strconv.Atoi(resPortStr)
+	if resIP == nil || err != nil {
+		return false
+	}
+
+	udp, err := dialPostCheck(ctx, "udp", net.JoinHostPort(relayIP.String(), strconv.Itoa(relayPort)), dialTimeout)
+	if err != nil {
+		return false
+	}
+	defer udp.Close()
+
+	_ = udp.SetDeadline(time.Now().Add(rwTimeout))
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := buildDNSQuery(id, qname)
+	if err != nil {
+		return false
+	}
+
+	// RSV, FRAG, ATYP, DST.ADDR, DST.PORT, DATA (RFC 1928 section 7).
+	pkt := []byte{0x00, 0x00, 0x00, socks5AtypIPv4}
+	pkt = append(pkt, resIP...)
+	pkt = binary.BigEndian.AppendUint16(pkt, uint16(resPort))
+	pkt = append(pkt, query...)
+	if _, err := udp.Write(pkt); err != nil {
+		return false
+	}
+
+	buf := make([]byte, 2048)
+	n, err := udp.Read(buf)
+	if err != nil {
+		return false
+	}
+	payload, ok := stripSOCKS5UDPHeader(buf[:n])
+	if !ok {
+		return false
+	}
+	return isDNSAnswer(payload, id)
+}
+
+func stripSOCKS5UDPHeader(b []byte) ([]byte, bool) {
+	if len(b) < 4 || b[2] != 0x00 {
+		return nil, false
+	}
+	off := 4
+	switch b[3] {
+	case socks5AtypIPv4:
+		off += net.IPv4len
+	case socks5AtypIPv6:
+		off += net.IPv6len
+	case socks5AtypDomain:
+		if len(b) < 5 {
+			return nil, false
+		}
+		off += 1 + int(b[4])
+	default:
+		return nil, false
+	}
+	off += 2
+	if len(b) < off {
+		return nil, false
+	}
+	return b[off:], true
+}
+
+// buildDNSQuery returns a recursive A query for name.
+func buildDNSQuery(id uint16, name string) ([]byte, error) {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	q = append(q, 0x01, 0x00) // RD
+	q = append(q, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("dns: invalid name %q", name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0x00)
+	q = append(q, 0x00, 0x01, 0x00, 0x01) // QTYPE A, QCLASS IN
+	return q, nil
+}
+
+// isDNSAnswer reports whether b is a successful response to query id with
+// at least one answer record.
+func isDNSAnswer(b []byte, id uint16) bool {
+	if len(b) < 12 {
+		return false
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != id {
+		return false
+	}
+	flags := binary.BigEndian.Uint16(b[2:4])
+	if flags&0x8000 == 0 || flags&0x000f != 0 {
+		return false
+	}
+	return binary.BigEndian.Uint16(b[6:8]) > 0
+}
+
+// validateSOCKS5 reports whether the proxy completes a SOCKS5 handshake
+// (no-auth, or username/password with -socks-user) and CONNECT to
+// testHost:80, along with the time from dial start to the CONNECT reply.
+func (v *validator) validateSOCKS5(proxyAddr string) (time.Duration, bool) {
+	start := time.Now()
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	if err := socks5Greet(conn, v.socksAuth); err != nil {
+		return 0, false
+	}
+	host := v.testHost
+	if v.testIP != nil {
+		host = v.testIP.String()
+	}
+	if _, _, err := socks5Request(conn, socks5CmdConnect, host, 80); err != nil {
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+// validateSOCKS4 reports whether the proxy grants a SOCKS4 CONNECT to the
+// pre-resolved IPv4 address of testHost on port 80, along with the time from
+// dial start to the reply.
+func (v *validator) validateSOCKS4(proxyAddr string) (time.Duration, bool) {
+	if v.testIP4 == nil {
+		return 0, false
+	}
+
+	start := time.Now()
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	// VN, CD, DSTPORT, DSTIP, empty USERID.
+	req := []byte{0x04, 0x01, 0x00, 80}
+	req = append(req, v.testIP4...)
+	req = append(req, 0x00)
+	if _, err := conn.Write(req); err != nil {
+		return 0, false
+	}
+
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return 0, false
+	}
+	if resp[0] != 0x00 || resp[1] != 0x5A {
+		return 0, false
+	}
+	return time.Since(start), true
+}
+
+// resolveIPv4 returns the first IPv4 address of host, or nil if it has none.
+func (v *validator) resolveIPv4(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.To4()
+	}
+	ips, err := v.lookupIP(host)
+	if err != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+	}
+	return nil
+}
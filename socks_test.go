@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSOCKS5Greet(t *testing.T) {
+	auth := &socks5Auth{user: "u", pass: "p"}
+	tests := []struct {
+		name    string
+		auth    *socks5Auth
+		method  byte
+		login   []byte // RFC 1929 reply, when the server picks username/password
+		wantErr bool
+		offered []byte
+	}{
+		{"no-auth", nil, socks5MethodNoAuth, nil, false, []byte{socks5Version, 1, socks5MethodNoAuth}},
+		{"no credentials to offer", nil, socks5MethodUser, nil, true, []byte{socks5Version, 1, socks5MethodNoAuth}},
+		{"login accepted", auth, socks5MethodUser, []byte{0x01, 0x00}, false, []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUser}},
+		{"login rejected", auth, socks5MethodUser, []byte{0x01, 0x01}, true, []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUser}},
+		{"bad login reply version", auth, socks5MethodUser, []byte{0x05, 0x00}, true, []byte{socks5Version, 2, socks5MethodNoAuth, socks5MethodUser}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			offered := make(chan []byte, 1)
+			go func() {
+				defer server.Close()
+				greeting := make([]byte, len(tt.offered))
+				if _, err := io.ReadFull(server, greeting); err != nil {
+					offered <- nil
+					return
+				}
+				offered <- greeting
+				server.Write([]byte{socks5Version, tt.method})
+				if tt.login != nil {
+					req := make([]byte, 3+len(tt.auth.user)+len(tt.auth.pass))
+					if _, err := io.ReadFull(server, req); err != nil {
+						return
+					}
+					server.Write(tt.login)
+				}
+			}()
+			err := socks5Greet(client, tt.auth)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("socks5Greet error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := <-offered; string(got) != string(tt.offered) {
+				t.Errorf("greeting = %x, want %x", got, tt.offered)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// sourceHistoryRuns is the rolling window of runs kept per source.
+	sourceHistoryRuns = 10
+	// minPruneRuns is how many runs a source needs on record before it can
+	// be pruned, so one bad run doesn't drop it.
+	minPruneRuns = 3
+)
+
+// sourceRun is one run's contribution from a source. Candidates counts
+// only those whose validation finished, not ones left unchecked by -max or
+// -total-timeout.
+type sourceRun struct {
+	Candidates uint64 `json:"candidates"`
+	Valid      uint64 `json:"valid"`
+	FetchMS    int64  `json:"fetch_ms,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+}
+
+// sourceState is the persisted per-source history used by
+// -prune-sources-below, keyed by source name.
+type sourceState map[string][]sourceRun
+
+func loadSourceState(path string) (sourceState, error) {
+	state := sourceState{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s sourceState) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, append(b, '\n'))
+}
+
+// ratio returns the share of a source's checked candidates that validated
+// over its recorded runs, and how many runs that covers. Runs in which
+// none of its candidates were checked, say because dedup credited them all
+// to other sources, are no sample and don't count.
+func (s sourceState) ratio(name string) (float64, int) {
+	var cand, valid uint64
+	runs := 0
+	for _, r := range s[name] {
+		if r.Candidates == 0 {
+			continue
+		}
+		cand += r.Candidates
+		valid += r.Valid
+		runs++
+	}
+	if cand == 0 {
+		return 0, 0
+	}
+	return float64(valid) / float64(cand), runs
+}
+
+// record appends this run's counts for every fetched source, keeping only
+// the last sourceHistoryRuns runs.
+func (s sourceState) record(st *stats) {
+	for name, ss := range st.perSource {
+		run := sourceRun{
+			Candidates: atomic.LoadUint64(&ss.checked),
+			Valid:      atomic.LoadUint64(&ss.valid),
+			FetchMS:    ss.fetchTime.Milliseconds(),
+			TimedOut:   ss.timedOut,
+		}
+		runs := append(s[name], run)
+		if len(runs) > sourceHistoryRuns {
+			runs = runs[len(runs)-sourceHistoryRuns:]
+		}
+		s[name] = runs
+	}
+}
+
+// prune drops sources whose historical success ratio is below min and
+// returns the kept sources and a description of each pruned one.
+func (s sourceState) prune(sources []Source, min float64) ([]Source, []string) {
+	var kept []Source
+	var pruned []string
+	for _, src := range sources {
+		ratio, runs := s.ratio(src.Name)
+		if runs >= minPruneRuns && ratio < min {
+			pruned = append(pruned, fmt.Sprintf("%s (%.2f%% valid over %d runs)", src.Name, 100*ratio, runs))
+			continue
+		}
+		kept = append(kept, src)
+	}
+	sort.Strings(pruned)
+	return kept, pruned
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSourceStatePrune(t *testing.T) {
+	s := sourceState{
+		// Every candidate went to other sources in dedup: no samples.
+		"dupes": {{}, {}, {}, {}},
+		"bad":   {{Candidates: 100}, {Candidates: 50, Valid: 1}, {Candidates: 80}},
+		"good":  {{Candidates: 100, Valid: 10}, {Candidates: 100, Valid: 20}, {Candidates: 100, Valid: 5}},
+		// Only two runs checked anything, too few to prune on.
+		"young": {{Candidates: 10}, {}, {Candidates: 10}},
+	}
+	if ratio, runs := s.ratio("dupes"); ratio != 0 || runs != 0 {
+		t.Errorf("ratio(dupes) = %v, %d, want 0, 0", ratio, runs)
+	}
+	if ratio, runs := s.ratio("young"); ratio != 0 || runs != 2 {
+		t.Errorf("ratio(young) = %v, %d, want 0, 2", ratio, runs)
+	}
+	sources := []Source{{Name: "dupes"}, {Name: "bad"}, {Name: "good"}, {Name: "young"}, {Name: "new"}}
+	kept, pruned := s.prune(sources, 0.05)
+	var names []string
+	for _, src := range kept {
+		names = append(names, src.Name)
+	}
+	if want := []string{"dupes", "good", "young", "new"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("kept %q, want %q", names, want)
+	}
+	if want := []string{"bad (0.43% valid over 3 runs)"}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("pruned %q, want %q", pruned, want)
+	}
+}
+
+func TestSourceStateRecordCountsChecked(t *testing.T) {
+	st := &stats{perSource: map[string]*sourceStats{
+		"src": {enqueued: 100, checked: 40, valid: 4},
+	}}
+	s := sourceState{}
+	s.record(st)
+	if got := s["src"]; len(got) != 1 || got[0].Candidates != 40 || got[0].Valid != 4 {
+		t.Errorf("recorded %+v, want 40 candidates, 4 valid", got)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+)
+
+// streamFlushInterval is how often streamed output is flushed to disk.
+const streamFlushInterval = time.Second
+
+// streamWriter appends each valid proxy to the text and NDJSON outputs as
+// soon as it validates, so a crash or -total-timeout mid-run loses at most
+// the last flush interval of results. NDJSON lines are flushed as they are
+// written, for readers such as jq following the file.
+type streamWriter struct {
+	mu    sync.Mutex
+	files []*os.File
+	ws    []*bufio.Writer
+	sinks []OutputSink
+	seen  map[string]struct{}
+	err   error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// streamable reports whether t is written a line per proxy and can be
+// streamed. Other formats and gzipped files can only be written once
+// complete.
+func streamable(t outputTarget) bool {
+	switch t.Sink.(type) {
+	case textSink, ndjsonSink:
+		return !t.Gzip
+	}
+	return false
+}
+
+// openStream opens every streamable target, truncating it unless
+// appendMode is set.
+func openStream(targets []outputTarget, appendMode bool) (*streamWriter, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if appendMode {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	s := &streamWriter{
+		seen: make(map[string]struct{}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, t := range targets {
+		if !streamable(t) {
+			continue
+		}
+		f, err := os.OpenFile(t.Path, flags, 0o644)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.ws = append(s.ws, bufio.NewWriterSize(f, 64*1024))
+		s.sinks = append(s.sinks, t.Sink)
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+// add writes r to every streamed output the first time its proxy is seen.
+func (s *streamWriter) add(r result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[r.Proxy]; ok {
+		return
+	}
+	s.seen[r.Proxy] = struct{}{}
+	out, results := []string{r.Proxy}, map[string]result{r.Proxy: r}
+	for i, w := range s.ws {
+		if err := s.sinks[i].Write(w, out, results); err != nil && s.err == nil {
+			s.err = err
+		}
+		if _, ok := s.sinks[i].(ndjsonSink); ok {
+			if err := w.Flush(); err != nil && s.err == nil {
+				s.err = err
+			}
+		}
+	}
+}
+
+func (s *streamWriter) flushLoop() {
+	defer close(s.done)
+	t := time.NewTicker(streamFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *streamWriter) flushLocked() {
+	for _, w := range s.ws {
+		if err := w.Flush(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+}
+
+// close flushes and closes the streamed outputs and returns the first
+// write error.
+func (s *streamWriter) close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	s.closeFiles()
+	return s.err
+}
+
+func (s *streamWriter) closeFiles() {
+	for _, f := range s.files {
+		if err := f.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+	}
+}
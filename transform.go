@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transformer rewrites an extracted candidate before dedup and validation.
+// Returning false drops the candidate.
+type Transformer func(candidate string) (string, bool)
+
+// builtinTransformers maps a transformer name to its constructor. The
+// argument is whatever follows the first ':' in the spec, e.g. "port:8080".
+var builtinTransformers = map[string]func(arg string) (Transformer, error){
+	"strip-scheme": noArg(func(s string) (string, bool) {
+		if i := strings.Index(s, "://"); i >= 0 {
+			s = s[i+3:]
+		}
+		return s, true
+	}),
+	"strip-credentials": noArg(func(s string) (string, bool) {
+		// A scheme in front stays, as it is still a protocol hint.
+		prefix := ""
+		if i := strings.Index(s, "://"); i >= 0 {
+			prefix, s = s[:i+3], s[i+3:]
+		}
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			s = s[i+1:]
+		}
+		return prefix + s, true
+	}),
+	"trim": noArg(func(s string) (string, bool) {
+		return strings.Trim(s, " \t\r\n/,;\"'"), true
+	}),
+	"port": func(arg string) (Transformer, error) {
+		p, err := strconv.Atoi(arg)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("port: invalid port %q", arg)
+		}
+		return func(s string) (string, bool) {
+			prefix, addr := cutURLPrefix(s)
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return s, true
+			}
+			return prefix + net.JoinHostPort(host, arg), true
+		}, nil
+	},
+	"drop-port": func(arg string) (Transformer, error) {
+		p, err := strconv.Atoi(arg)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("drop-port: invalid port %q", arg)
+		}
+		return func(s string) (string, bool) {
+			_, addr := cutURLPrefix(s)
+			_, port, err := net.SplitHostPort(strings.TrimSuffix(addr, "/"))
+			return s, err != nil || port != arg
+		}, nil
+	},
+}
+
+// cutURLPrefix splits a candidate written as a URL into its scheme:// and
+// user:pass@ prefix and the host:port after it, so transformers that work
+// on the address keep the prefix, and with it the protocol hint.
+func cutURLPrefix(s string) (prefix, addr string) {
+	if i := strings.Index(s, "://"); i >= 0 {
+		prefix, s = s[:i+3], s[i+3:]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		prefix, s = prefix+s[:i+1], s[i+1:]
+	}
+	return prefix, s
+}
+
+func noArg(t Transformer) func(string) (Transformer, error) {
+	return func(arg string) (Transformer, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("takes no argument, got %q", arg)
+		}
+		return t, nil
+	}
+}
+
+// parseTransformer builds a transformer from a "name" or "name:arg" spec.
+func parseTransformer(spec string) (Transformer, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	ctor, ok := builtinTransformers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transformer %q (available: %s)", name, strings.Join(transformerNames(), ", "))
+	}
+	t, err := ctor(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+func transformerNames() []string {
+	names := make([]string, 0, len(builtinTransformers))
+	for name := range builtinTransformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transformList is a repeatable -transform flag, parsed as it is set.
+type transformList struct {
+	specs []string
+	fns   []Transformer
+}
+
+func (l *transformList) String() string { return strings.Join(l.specs, ",") }
+
+func (l *transformList) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		t, err := parseTransformer(spec)
+		if err != nil {
+			return err
+		}
+		l.specs = append(l.specs, strings.TrimSpace(spec))
+		l.fns = append(l.fns, t)
+	}
+	return nil
+}
+
+// applyTransforms runs each transformer in order, stopping at the first one
+// that drops the candidate.
+func applyTransforms(s string, chains ...[]Transformer) (string, bool) {
+	for _, chain := range chains {
+		for _, t := range chain {
+			var ok bool
+			if s, ok = t(s); !ok {
+				return "", false
+			}
+		}
+	}
+	return s, true
+}
@@ -0,0 +1,6 @@
+//go:build !(linux || darwin)
+
+package main
+
+// processUmask is zero on platforms without a umask.
+var processUmask uint32
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// processUmask is the file mode creation mask the process started with. It
+// is read once, before any goroutine creates files, since reading it means
+// setting it.
+var processUmask = func() uint32 {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return uint32(mask)
+}()
@@ -0,0 +1,1357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validator holds the settings shared by every probe of a run.
+type validator struct {
+	mode        string
+	testHost    string
+	dialTimeout time.Duration
+	rwTimeout   time.Duration
+	probe       *probeRequest
+	cache       *resultCache
+	originForm  bool
+	// minBody is the -min-body-bytes threshold for HTTP responses.
+	minBody int64
+	// judgeToken, set with -judge, must appear in the body of HTTP
+	// validation responses.
+	judgeToken []byte
+
+	// connectTLS, when set, makes CONNECT validation complete a TLS
+	// handshake with testHost through the tunnel.
+	connectTLS *tls.Config
+	// tlsInfo records the negotiated TLS version and cipher suite of each
+	// CONNECT-TLS handshake in the result.
+	tlsInfo bool
+	// socksAuth, set with -socks-user, lets SOCKS5 validation log in to
+	// proxies that require username/password authentication.
+	socksAuth *socks5Auth
+	// proxyTLS is the client config for https mode, where TLS is set up
+	// with the proxy itself before the probe request is sent.
+	proxyTLS *tls.Config
+	// tlsBase carries -tls-min and -tls-insecure; every TLS config the
+	// validator uses is cloned from it. nil means the defaults.
+	tlsBase *tls.Config
+	// viaSOCKS, set with -via-socks, is an upstream SOCKS5 proxy every
+	// validation dial is tunnelled through.
+	viaSOCKS string
+
+	// dials, when set, records every validation dial for -auto-tune.
+	dials *dialCounters
+	// budget enforces -max-connections on every dial.
+	budget *dialBudget
+	// ctx is the run's root context. Cancelling it aborts pending dials
+	// and cuts short connections still in use, so -max and -total-timeout
+	// take effect without waiting out the timeouts. nil means no
+	// cancellation.
+	ctx context.Context
+
+	// testIP4 is testHost resolved once at startup for SOCKS4, which can
+	// only address IPv4 destinations. nil disables SOCKS4 probing.
+	testIP4 net.IP
+	// testIP is set by -prewarm; SOCKS5 requests then address testHost by
+	// it instead of by name.
+	testIP net.IP
+	// resolver, set with -dns, looks up testHost for testIP4 and testIP.
+	// nil means the system resolver.
+	resolver *net.Resolver
+
+	// hosts, set when -test-host lists several hosts, are tried in order
+	// until quorum of them pass. testHost, probe, testIP4 and testIP are
+	// then those of the first one.
+	hosts  []testTarget
+	quorum int
+}
+
+// testTarget is one -test-host entry with its own probe and addresses.
+type testTarget struct {
+	host    string
+	probe   *probeRequest
+	testIP4 net.IP
+	testIP  net.IP
+}
+
+// probeRequest is the request template sent by validateHTTP.
+type probeRequest struct {
+	Method string
+	URL    *url.URL
+	Header http.Header
+
+	raw       []byte
+	rawOrigin []byte
+	// rawKeep is raw asking for a persistent connection, sent when a
+	// failed probe's connection can carry the next protocol's attempt.
+	rawKeep []byte
+}
+
+// defaultProbeRequest is the plain GET to testHost used when no
+// -probe-request is given.
+func defaultProbeRequest(testHost string) *probeRequest {
+	p := &probeRequest{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "http", Host: testHost, Path: "/"},
+		Header: http.Header{},
+	}
+	p.build()
+	return p
+}
+
+// parseProbeRequest parses a -probe-request spec of the form
+//
+//	METHOD URL[|Header: value]...
+//
+// for example "GET http://example.com/health|Host: api.internal|X-Token: 1".
+func parseProbeRequest(spec string) (*probeRequest, error) {
+	parts := strings.Split(spec, "|")
+	line := strings.Fields(parts[0])
+	if len(line) != 2 {
+		return nil, fmt.Errorf("probe request must start with \"METHOD URL\", got %q", parts[0])
+	}
+
+	method := strings.ToUpper(line[0])
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return nil, fmt.Errorf("invalid method %q", line[0])
+		}
+	}
+
+	u, err := url.Parse(line[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("URL must be absolute http://, got %q", line[1])
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	p := &probeRequest{Method: method, URL: u, Header: http.Header{}}
+	for _, h := range parts[1:] {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q, want \"Name: value\"", strings.TrimSpace(h))
+		}
+		p.Header.Add(name, strings.TrimSpace(value))
+	}
+	p.build()
+	return p, nil
+}
+
+// build renders the request once so workers only have to write bytes: raw
+// in the absolute-form forward proxies expect, rawOrigin in origin-form for
+// the -origin-form-fallback retry, and rawKeep for shared probe sessions.
+func (p *probeRequest) build() {
+	p.raw = p.render(p.URL.String(), "close")
+	p.rawOrigin = p.render(p.URL.RequestURI(), "close")
+	p.rawKeep = p.render(p.URL.String(), "keep-alive")
+}
+
+func (p *probeRequest) render(target, connection string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", p.Method, target)
+
+	host := p.URL.Host
+	if h := p.Header.Get("Host"); h != "" {
+		host = h
+	}
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	if p.Header.Get("User-Agent") == "" {
+		b.WriteString("User-Agent: proxy-scraper/1.0\r\n")
+	}
+	names := make([]string, 0, len(p.Header))
+	for name := range p.Header {
+		if name != "Host" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range p.Header[name] {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, v)
+		}
+	}
+	fmt.Fprintf(&b, "Connection: %s\r\n\r\n", connection)
+	return []byte(b.String())
+}
+
+// prewarm resolves testHost once before the worker pool starts and opens
+// one direct connection to it, so the first wave of workers doesn't all pay
+// for cold lookups and routes at the same moment. HTTP and CONNECT probes
+// still name the host, since the proxy resolves those.
+func (v *validator) prewarm() error {
+	ips, err := v.lookupIP(v.testHost)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v.testIP = ip4
+			break
+		}
+	}
+	if v.testIP == nil {
+		v.testIP = ips[0]
+	}
+	if v.testIP4 == nil {
+		v.testIP4 = v.testIP.To4()
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort(v.testIP.String(), "80"), v.dialTimeout); err == nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// lookupIP resolves host with v.resolver.
+func (v *validator) lookupIP(host string) ([]net.IP, error) {
+	r := v.resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return r.LookupIP(context.Background(), "ip", host)
+}
+
+// newDNSResolver returns a resolver that sends every query to server
+// (host:port, or just a host for port 53) instead of the servers in the
+// system configuration.
+func newDNSResolver(server string, timeout time.Duration) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("%q is not a host:port", server)
+	}
+	d := &net.Dialer{Timeout: timeout}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+// dial opens a TCP connection to a proxy under test. The connection's
+// deadline is moved to now if v.ctx ends before it is closed.
+func (v *validator) dial(addr string) (net.Conn, error) {
+	return v.dialContext(v.runContext(), addr)
+}
+
+// runContext returns v.ctx, or the background context outside a run.
+func (v *validator) runContext() context.Context {
+	if v.ctx == nil {
+		return context.Background()
+	}
+	return v.ctx
+}
+
+// dialContext is dial tied to ctx, which should be v.ctx or derived from
+// it.
+func (v *validator) dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if !v.budget.take() {
+		return nil, errDialBudget
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if v.viaSOCKS != "" {
+		conn, err = dialVia(ctx, v.viaSOCKS, addr, v.dialTimeout)
+	} else {
+		conn, err = (&net.Dialer{Timeout: v.dialTimeout}).DialContext(ctx, "tcp", addr)
+	}
+	if ctx.Err() != nil {
+		// Not the proxy's fault; keep it out of the -auto-tune counts.
+		if err == nil {
+			conn.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if v.dials != nil {
+		v.dials.record(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	return &ctxConn{Conn: conn, ctx: ctx, stop: stop}, nil
+}
+
+// dialPostCheck connects to addr for a post-validation check, which takes
+// its own -max-connections budget and stays out of the -auto-tune counts.
+// Like dialContext, the connection is cut once ctx ends.
+func dialPostCheck(ctx context.Context, network, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	return &ctxConn{Conn: conn, ctx: ctx, stop: stop}, nil
+}
+
+// ctxConn is a connection from dial. Once its context ends, deadlines can
+// only be set to now, and closing it stops watching the context.
+type ctxConn struct {
+	net.Conn
+	ctx  context.Context
+	stop func() bool
+}
+
+func (c *ctxConn) SetDeadline(t time.Time) error {
+	if c.ctx.Err() != nil {
+		t = time.Now()
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// fingerprint identifies the settings that affect validation verdicts.
+func (v *validator) fingerprint() string {
+	hosts := v.testHost
+	if len(v.hosts) > 0 {
+		names := make([]string, len(v.hosts))
+		for i, t := range v.hosts {
+			names[i] = t.host
+		}
+		hosts = fmt.Sprintf("%s/%d", strings.Join(names, ","), v.quorum)
+	}
+	tlsKey := strconv.FormatBool(v.connectTLS != nil)
+	if b := v.tlsBase; b != nil && (b.MinVersion != tls.VersionTLS12 || b.InsecureSkipVerify) {
+		tlsKey += fmt.Sprintf("/%#x/%t", b.MinVersion, b.InsecureSkipVerify)
+	}
+	if v.proxyTLS != nil && v.proxyTLS.InsecureSkipVerify {
+		tlsKey += "/insecure"
+	}
+	auth := ""
+	if v.socksAuth != nil {
+		auth = v.socksAuth.user + "\x00" + v.socksAuth.pass
+	}
+	return fmt.Sprintf("%s\n%s\n%t\n%s\n%t\n%d\n%s\n%s\n%s\n%s", v.mode, hosts, v.originForm, tlsKey, v.tlsInfo, v.minBody, v.judgeToken, v.probe.raw, auth, v.viaSOCKS)
+}
+
+// validate probes proxy, answering from the result cache when a fresh
+// verdict is available. A non-empty mode overrides -mode for this proxy.
+func (v *validator) validate(proxy, mode string) (result, bool) {
+	if mode == "" {
+		mode = strings.ToLower(strings.TrimSpace(v.mode))
+	}
+	key := proxy + "|" + mode
+	if v.cache != nil {
+		if r, ok, hit := v.cache.get(key); hit {
+			return r, ok
+		}
+	}
+	r, ok := v.probeProxy(proxy, mode)
+	if v.cache != nil {
+		v.cache.put(key, r, ok)
+	}
+	return r, ok
+}
+
+// validateBackoff validates proxy and, while attempts remain and the last
+// try failed slowly enough to have hit a timeout, tries again with the dial
+// and read/write timeouts multiplied by factor each time. Attempts that fail
+// fast (refused, bad status) are not retried. The result's Timeout is set
+// to the read/write timeout of a retry that succeeded.
+func (v *validator) validateBackoff(proxy, mode string, factor float64, attempts int) (result, bool) {
+	if mode == "" {
+		mode = strings.ToLower(strings.TrimSpace(v.mode))
+	}
+	start := time.Now()
+	r, ok := v.validate(proxy, mode)
+	slow := minDuration(v.dialTimeout, v.rwTimeout)
+
+	retry := *v
+	retry.cache = nil
+	for i := 1; i < attempts && !ok && time.Since(start) >= slow; i++ {
+		retry.dialTimeout = time.Duration(float64(retry.dialTimeout) * factor)
+		retry.rwTimeout = time.Duration(float64(retry.rwTimeout) * factor)
+		slow = minDuration(retry.dialTimeout, retry.rwTimeout)
+		start = time.Now()
+		if r, ok = retry.probeProxy(proxy, mode); ok {
+			r.Timeout = retry.rwTimeout
+			if v.cache != nil {
+				v.cache.put(proxy+"|"+mode, r, true)
+			}
+		}
+	}
+	return r, ok
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// normalizeMode maps a protocol hint to a validation mode, or "" if the hint
+// isn't recognised.
+func normalizeMode(hint string) string {
+	switch h := strings.ToLower(strings.TrimSpace(hint)); h {
+	case "http", "connect", "both", "all", "auto", "socks5", "socks4":
+		return h
+	case "https":
+		return "connect"
+	}
+	return ""
+}
+
+// probeProxy runs one validation of proxy. With several test hosts it
+// probes each in turn, stopping once quorum have passed or too few remain to
+// reach it, and returns the result of the first host that passed with
+// TestHosts listing every host that did.
+func (v *validator) probeProxy(proxy, mode string) (result, bool) {
+	if len(v.hosts) == 0 {
+		return v.probeHost(proxy, mode)
+	}
+	var (
+		first  result
+		passed []string
+	)
+	for i, t := range v.hosts {
+		if len(passed)+len(v.hosts)-i < v.quorum {
+			break
+		}
+		c := *v
+		c.hosts = nil
+		c.testHost, c.probe, c.testIP4, c.testIP = t.host, t.probe, t.testIP4, t.testIP
+		r, ok := c.probeHost(proxy, mode)
+		if len(passed) == 0 {
+			first = r
+		}
+		if !ok {
+			continue
+		}
+		passed = append(passed, t.host)
+		if len(passed) >= v.quorum {
+			break
+		}
+	}
+	first.TestHosts = passed
+	return first, len(passed) >= v.quorum
+}
+
+func (v *validator) probeHost(proxy, mode string) (result, bool) {
+	r := result{Proxy: proxy, CheckedAt: time.Now().UTC()}
+	var ok bool
+	switch mode {
+	case "http":
+		r.Protocol = "http"
+		s := v.newSession(proxy, v.originForm)
+		ok = v.probeHTTP(s, &r)
+		s.close()
+	case "connect":
+		r.Protocol = "connect"
+		s := v.newSession(proxy, false)
+		ok = v.probeCONNECT(s, &r)
+		s.close()
+	case "socks5":
+		r.Protocol = "socks5"
+		r.Status = socks5Granted
+		r.Latency, ok = v.validateSOCKS5(proxy)
+	case "socks4":
+		r.Protocol = "socks4"
+		r.Status = socks4Granted
+		r.Latency, ok = v.validateSOCKS4(proxy)
+	case "https":
+		r.Protocol = "https"
+		r.Latency, r.Status, ok = v.validateHTTPS(proxy, v.probe.raw)
+	case "auto":
+		s := v.newSession(proxy, true)
+		ok = v.detectProtocol(s, &r)
+		s.close()
+	case "all":
+		// both, then SOCKS5 for proxies that speak neither HTTP dialect.
+		s := v.newSession(proxy, true)
+		if ok = v.probeBoth(s, &r); !ok && !s.unreachable() {
+			s.close()
+			r.Protocol = "socks5"
+			r.Status = socks5Granted
+			r.Latency, ok = v.validateSOCKS5(proxy)
+		}
+		s.close()
+	default:
+		s := v.newSession(proxy, true)
+		ok = v.probeBoth(s, &r)
+		s.close()
+	}
+	return r, ok
+}
+
+// probeSession lets the successive attempts of one candidate's probe share
+// a connection: an attempt that fails with a complete, keep-alive HTTP
+// response hands its connection to the next attempt instead of closing it,
+// and once a dial has failed no later attempt dials the candidate again.
+// In auto mode this cuts the dials for a dead candidate from three to one,
+// and for a CONNECT-only proxy that answers the GET cleanly from two to one.
+type probeSession struct {
+	v     *validator
+	addr  string
+	reuse bool
+	// ctx, when set, ends the session's connections early; otherwise they
+	// live as long as the run.
+	ctx context.Context
+
+	conn     net.Conn
+	br       *bufio.Reader
+	dialTime time.Duration
+	dialErr  error
+}
+
+// newSession starts a probe session for addr. With reuse false every
+// attempt gets its own connection, as a single-attempt probe needs no more.
+func (v *validator) newSession(addr string, reuse bool) *probeSession {
+	return &probeSession{v: v, addr: addr, reuse: reuse}
+}
+
+// get returns the connection for the next attempt, its reader, and the time
+// latency is measured from. A reused connection's start is backdated by the
+// original dial time so latencies stay comparable with fresh dials.
+func (s *probeSession) get() (net.Conn, *bufio.Reader, time.Time, error) {
+	if s.dialErr != nil {
+		return nil, nil, time.Time{}, s.dialErr
+	}
+	if conn := s.conn; conn != nil {
+		br := s.br
+		s.conn, s.br = nil, nil
+		_ = conn.SetDeadline(time.Now().Add(s.v.rwTimeout))
+		return conn, br, time.Now().Add(-s.dialTime), nil
+	}
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = s.v.runContext()
+	}
+	start := time.Now()
+	conn, err := s.v.dialContext(ctx, s.addr)
+	if err != nil {
+		s.dialErr = err
+		return nil, nil, time.Time{}, err
+	}
+	s.dialTime = time.Since(start)
+	_ = conn.SetDeadline(time.Now().Add(s.v.rwTimeout))
+	return conn, bufio.NewReaderSize(conn, 4096), start, nil
+}
+
+// release takes back conn after an attempt was refused with status line
+// line, keeping it for the next attempt if the rest of the response can be
+// read off and the proxy left the connection open.
+func (s *probeSession) release(conn net.Conn, br *bufio.Reader, line string) {
+	if s.reuse && finishResponse(br, line) {
+		s.conn, s.br = conn, br
+		return
+	}
+	conn.Close()
+}
+
+// unreachable reports whether dialing the candidate failed.
+func (s *probeSession) unreachable() bool {
+	return s.dialErr != nil
+}
+
+// close closes a connection left over from the last attempt.
+func (s *probeSession) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.br = nil, nil
+	}
+}
+
+// connectHeadStart is how long probeBoth gives the HTTP probe before
+// starting the CONNECT one on a second connection.
+const connectHeadStart = 300 * time.Millisecond
+
+// probeBoth runs a forwarded HTTP request over s and the CONNECT probes
+// after it. HTTP gets a head start of connectHeadStart: if it finishes by
+// then, a success needs no CONNECT probe, and a failure is followed by one
+// over the same session, reusing its connection where it can. A refused
+// or quickly answering candidate so costs no more dials than probing one
+// protocol after the other. Only if the HTTP probe is still waiting does
+// the CONNECT probe start on a connection of its own, so a hanging
+// candidate costs one timeout instead of two, at the price of a second
+// dial against -max-connections and, for a while, a second open socket
+// per worker. From then on the first success wins and cuts the other
+// probe's connection, so a candidate answering both may be labelled
+// either way. Both goroutines have finished when probeBoth returns.
+func (v *validator) probeBoth(s *probeSession, r *result) bool {
+	// The CONNECT probe starts from r as it is now, not as the HTTP probe
+	// leaves it.
+	rc := *r
+	rc.Tags = append([]string(nil), r.Tags...)
+	r.Protocol = "http"
+
+	// hctx ends the HTTP probe once CONNECT succeeds, including over a
+	// connection the session already holds.
+	parent := s.ctx
+	if parent == nil {
+		parent = v.runContext()
+	}
+	hctx, hcancel := context.WithCancel(parent)
+	defer hcancel()
+	defer func(prev context.Context) { s.ctx = prev }(s.ctx)
+	s.ctx = hctx
+	if c := s.conn; c != nil {
+		stop := context.AfterFunc(hctx, func() { _ = c.SetDeadline(time.Now()) })
+		s.conn = &ctxConn{Conn: c, ctx: hctx, stop: stop}
+	}
+	httpDone := make(chan bool, 1)
+	go func() { httpDone <- v.probeHTTP(s, r) }()
+
+	timer := time.NewTimer(connectHeadStart)
+	defer timer.Stop()
+	select {
+	case ok := <-httpDone:
+		if ok {
+			return true
+		}
+		if s.unreachable() {
+			return false
+		}
+		r.Protocol = "connect"
+		return v.probeCONNECT(s, r) || v.probeConnectHTTP(s, r)
+	case <-timer.C:
+	}
+
+	ctx, cancel := context.WithCancel(v.runContext())
+	defer cancel()
+	cs := &probeSession{v: v, addr: s.addr, reuse: true, ctx: ctx}
+	done := make(chan bool, 1)
+	go func() {
+		defer cs.close()
+		rc.Protocol = "connect"
+		done <- v.probeCONNECT(cs, &rc) || v.probeConnectHTTP(cs, &rc)
+	}()
+
+	select {
+	case ok := <-httpDone:
+		if ok {
+			cancel()
+			<-done
+			return true
+		}
+		ok = <-done
+		*r = rc
+		return ok
+	case ok := <-done:
+		if !ok {
+			return <-httpDone
+		}
+		hcancel()
+		<-httpDone
+		*r = rc
+		return true
+	}
+}
+
+// detectProtocol tries every supported protocol in turn for candidates from
+// unlabelled, mixed lists, recording the first one that works. Candidates
+// that speak none of them are simply invalid.
+func (v *validator) detectProtocol(s *probeSession, r *result) bool {
+	if v.probeHTTP(s, r) {
+		r.Protocol = "http"
+		return true
+	}
+	if v.probeCONNECT(s, r) || v.probeConnectHTTP(s, r) {
+		r.Protocol = "connect"
+		return true
+	}
+	if s.unreachable() {
+		return false
+	}
+	// SOCKS handshakes need a connection of their own.
+	s.close()
+	proxy := s.addr
+	probes := []struct {
+		proto  string
+		status string
+		fn     func(string) (time.Duration, bool)
+	}{
+		{"socks5", socks5Granted, v.validateSOCKS5},
+		{"socks4", socks4Granted, v.validateSOCKS4},
+	}
+	for _, p := range probes {
+		var ok bool
+		if r.Latency, ok = p.fn(proxy); ok {
+			r.Protocol, r.Status = p.proto, p.status
+			return true
+		}
+	}
+	return false
+}
+
+// probeHTTP sends the probe request in absolute-form and, with
+// -origin-form-fallback, retries in origin-form for proxies that only accept
+// that. A proxy that needed the retry is tagged origin-form.
+func (v *validator) probeHTTP(s *probeSession, r *result) bool {
+	req := v.probe.raw
+	if s.reuse {
+		req = v.probe.rawKeep
+	}
+	var ok bool
+	if r.Latency, r.Status, ok = v.validateHTTP(s, req); ok || !v.originForm {
+		return ok
+	}
+	if r.Latency, r.Status, ok = v.validateHTTP(s, v.probe.rawOrigin); ok {
+		r.Tags = append(r.Tags, "origin-form")
+	}
+	return ok
+}
+
+// validateHTTP reports whether the proxy answers req with a 2xx/3xx status,
+// along with the time from dial start to the first response line and the
+// status line itself.
+func (v *validator) validateHTTP(s *probeSession, req []byte) (time.Duration, string, bool) {
+	conn, br, start, err := s.get()
+	if err != nil {
+		return 0, "", false
+	}
+	if _, err := conn.Write(req); err != nil {
+		conn.Close()
+		return 0, "", false
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return 0, "", false
+	}
+	latency := time.Since(start)
+	if !okStatus(line) {
+		s.release(conn, br, line)
+		return 0, "", false
+	}
+	defer conn.Close()
+	if v.bodyOK(br) {
+		return latency, strings.TrimSpace(line), true
+	}
+	return 0, "", false
+}
+
+// validateHTTPS is validateHTTP for HTTPS proxies: the request is sent over
+// a TLS session with the proxy itself rather than in the clear. The
+// certificate is checked against the proxy's address unless -insecure is
+// set.
+func (v *validator) validateHTTPS(proxyAddr string, req []byte) (time.Duration, string, bool) {
+	start := time.Now()
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return 0, "", false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	cfg := &tls.Config{}
+	if v.proxyTLS != nil {
+		cfg = v.proxyTLS.Clone()
+	}
+	if host, _, err := net.SplitHostPort(proxyAddr); err == nil {
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return 0, "", false
+	}
+	return v.exchange(tc, req, start)
+}
+
+// exchange writes req to an open proxy connection and checks the response,
+// measuring latency from start to the first response line.
+func (v *validator) exchange(conn net.Conn, req []byte, start time.Time) (time.Duration, string, bool) {
+	if _, err := conn.Write(req); err != nil {
+		return 0, "", false
+	}
+
+	r := bufio.NewReaderSize(conn, 4096)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, "", false
+	}
+	latency := time.Since(start)
+	if okStatus(line) && v.bodyOK(r) {
+		return latency, strings.TrimSpace(line), true
+	}
+	return 0, "", false
+}
+
+// okStatus reports whether an HTTP status line carries a 2xx/3xx code.
+func okStatus(line string) bool {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "HTTP/1.1 ") && !strings.HasPrefix(line, "HTTP/1.0 ") {
+		return false
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) < 2 {
+		return false
+	}
+	code, err := strconv.Atoi(parts[1])
+	return err == nil && code >= 200 && code < 400
+}
+
+// judgeBodyMax caps how much of a response is searched for the judge
+// token.
+const judgeBodyMax = 64 * 1024
+
+// bodyOK enforces -min-body-bytes and -judge on the response whose status
+// line was just read from r: the body must have at least minBody bytes and
+// contain the judge token within its first judgeBodyMax bytes. Only as much
+// as the checks need is read, so they stay cheap.
+func (v *validator) bodyOK(r *bufio.Reader) bool {
+	if v.minBody <= 0 && v.judgeToken == nil {
+		return true
+	}
+	chunked := false
+	length := int64(-1)
+	for {
+		h, err := r.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		h = strings.TrimSpace(h)
+		if h == "" {
+			break
+		}
+		name, value, _ := strings.Cut(h, ":")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "content-length":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				if n < v.minBody {
+					return false
+				}
+				length = n
+			}
+		case "transfer-encoding":
+			chunked = strings.Contains(strings.ToLower(value), "chunked")
+		}
+	}
+	var body io.Reader = r
+	switch {
+	case chunked:
+		body = httputil.NewChunkedReader(r)
+	case length >= 0:
+		// Don't wait for more on a connection the proxy keeps open.
+		body = io.LimitReader(r, length)
+	}
+	if v.judgeToken == nil {
+		n, _ := io.Copy(io.Discard, io.LimitReader(body, v.minBody))
+		return n >= v.minBody
+	}
+	limit := int64(judgeBodyMax)
+	if v.minBody > limit {
+		limit = v.minBody
+	}
+	b, _ := io.ReadAll(io.LimitReader(body, limit))
+	return int64(len(b)) >= v.minBody && bytes.Contains(b, v.judgeToken)
+}
+
+// fetchJudgeToken requests the -judge URL directly and returns its body,
+// trimmed, as the token proxied responses must contain.
+func fetchJudgeToken(u string, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("judge: " + resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, judgeBodyMax))
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("judge returned an empty body")
+	}
+	return b, nil
+}
+
+// maxDrainBody caps the body of a refused response that is read off so the
+// connection can be reused.
+const maxDrainBody = 64 * 1024
+
+// finishResponse reads the rest of a response whose status line, line, was
+// just read from r, and reports whether the connection is left clean for
+// another request: the proxy must keep it open and frame the body with
+// Content-Length or chunked encoding.
+func finishResponse(r *bufio.Reader, line string) bool {
+	keep := strings.HasPrefix(line, "HTTP/1.1 ")
+	length := int64(-1)
+	chunked := false
+	if f := strings.Fields(line); len(f) > 1 && (f[1] == "204" || f[1] == "304") {
+		length = 0
+	}
+	for {
+		h, err := r.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		h = strings.TrimSpace(h)
+		if h == "" {
+			break
+		}
+		name, value, _ := strings.Cut(h, ":")
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch strings.ToLower(name) {
+		case "connection", "proxy-connection":
+			if strings.Contains(value, "close") {
+				keep = false
+			} else if strings.Contains(value, "keep-alive") {
+				keep = true
+			}
+		case "content-length":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return false
+			}
+			length = n
+		case "transfer-encoding":
+			chunked = strings.Contains(value, "chunked")
+		}
+	}
+	if !keep {
+		return false
+	}
+	switch {
+	case chunked:
+		n, err := io.Copy(io.Discard, io.LimitReader(httputil.NewChunkedReader(r), maxDrainBody))
+		if err != nil || n == maxDrainBody || !drainHead(r) {
+			return false
+		}
+	case length >= 0 && length <= maxDrainBody:
+		if _, err := io.CopyN(io.Discard, r, length); err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	return r.Buffered() == 0
+}
+
+// drainHead consumes the rest of a response head so a tunnel starts clean.
+// It fails if the proxy already sent bytes past the head.
+func drainHead(r *bufio.Reader) bool {
+	for {
+		h, err := r.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		if strings.TrimSpace(h) == "" {
+			break
+		}
+	}
+	return r.Buffered() == 0
+}
+
+// probeCONNECT validates a CONNECT tunnel and, with -tls-fingerprint,
+// records what the TLS handshake through it negotiated.
+func (v *validator) probeCONNECT(s *probeSession, r *result) bool {
+	latency, status, cs, ok := v.validateCONNECT(s)
+	if !ok {
+		return false
+	}
+	r.Latency, r.Status = latency, status
+	if v.tlsInfo && cs != nil {
+		r.TLS = tlsFingerprint(cs)
+	}
+	return true
+}
+
+// validateCONNECT reports whether the proxy accepts a CONNECT tunnel, along
+// with the time from dial start to the first response line and that line.
+// With -connect-tls the state of the handshake through the tunnel is
+// returned too.
+func (v *validator) validateCONNECT(s *probeSession) (time.Duration, string, *tls.ConnectionState, bool) {
+	conn, r, start, err := s.get()
+	if err != nil {
+		return 0, "", nil, false
+	}
+
+	fmt.Fprintf(conn,
+		"CONNECT %s:443 HTTP/1.1\r\nHost: %s:443\r\nProxy-Connection: keep-alive\r\n\r\n",
+		v.testHost, v.testHost,
+	)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return 0, "", nil, false
+	}
+	latency := time.Since(start)
+
+	if !strings.HasPrefix(line, "HTTP/1.1 200") && !strings.HasPrefix(line, "HTTP/1.0 200") {
+		s.release(conn, r, line)
+		return 0, "", nil, false
+	}
+	defer conn.Close()
+	line = strings.TrimSpace(line)
+	if v.connectTLS == nil {
+		return latency, line, nil, true
+	}
+
+	if !drainHead(r) {
+		return 0, "", nil, false
+	}
+
+	cfg := v.connectTLS.Clone()
+	cfg.ServerName = v.testHost
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return 0, "", nil, false
+	}
+	cs := tc.ConnectionState()
+	return latency, line, &cs, true
+}
+
+// validateConnectHTTP reports whether the proxy serves the probe request
+// through a CONNECT tunnel to the probe host's plain HTTP port. This covers
+// proxies that reject absolute-form requests and won't tunnel to 443 but do
+// tunnel to 80. The latency is measured to the first response line from
+// the tunnel, which is returned as the status.
+func (v *validator) validateConnectHTTP(s *probeSession) (time.Duration, string, bool) {
+	target := v.probe.URL.Host
+	if v.probe.URL.Port() == "" {
+		target = net.JoinHostPort(v.probe.URL.Hostname(), "80")
+	}
+
+	conn, r, start, err := s.get()
+	if err != nil {
+		return 0, "", false
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, "", false
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "HTTP/1.1 200") && !strings.HasPrefix(line, "HTTP/1.0 200") {
+		return 0, "", false
+	}
+	if !drainHead(r) {
+		return 0, "", false
+	}
+
+	if _, err := conn.Write(v.probe.rawOrigin); err != nil {
+		return 0, "", false
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return 0, "", false
+	}
+	latency := time.Since(start)
+	if okStatus(line) && v.bodyOK(r) {
+		return latency, strings.TrimSpace(line), true
+	}
+	return 0, "", false
+}
+
+// probeConnectHTTP runs validateConnectHTTP, tagging proxies that pass
+// http-via-connect.
+func (v *validator) probeConnectHTTP(s *probeSession, r *result) bool {
+	var ok bool
+	if r.Latency, r.Status, ok = v.validateConnectHTTP(s); ok {
+		r.Tags = append(r.Tags, "http-via-connect")
+	}
+	return ok
+}
+
+// checkHeaders sends req, a GET to a header-reflecting endpoint carrying
+// the -header-test headers, through the proxy and reports whether every
+// test header arrived intact: its name and exact value must both appear in
+// the echoed response body. ok is false if the request itself failed.
+func (v *validator) checkHeaders(proxyAddr string, req *probeRequest) (preserved, ok bool) {
+	body, ok := v.echo(proxyAddr, req)
+	if !ok {
+		return false, false
+	}
+	lower := strings.ToLower(string(body))
+	for name, values := range req.Header {
+		if name == "Host" || name == "User-Agent" {
+			continue
+		}
+		if !strings.Contains(lower, strings.ToLower(name)) {
+			return false, true
+		}
+		for _, val := range values {
+			if !strings.Contains(string(body), val) {
+				return false, true
+			}
+		}
+	}
+	return true, true
+}
+
+// checkAnonymity asks the anonymity judge through the proxy and returns
+// the level its echo shows. ok is false if the request failed.
+func (v *validator) checkAnonymity(proxyAddr string, a *anonymityCheck) (level string, ok bool) {
+	body, ok := v.echo(proxyAddr, a.req)
+	if !ok {
+		return "", false
+	}
+	return a.level(body), true
+}
+
+// echo sends req through the proxy and returns the start of a 2xx
+// response's body.
+func (v *validator) echo(proxyAddr string, req *probeRequest) ([]byte, bool) {
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return nil, false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	if _, err := conn.Write(req.raw); err != nil {
+		return nil, false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, false
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return body, true
+}
+
+// frontCheck describes a domain-fronting test: CONNECT to connect, then
+// complete a TLS handshake with SNI sni and, if httpHost is set, fetch /
+// with that Host header over the TLS session.
+type frontCheck struct {
+	connect  string
+	sni      string
+	httpHost string
+}
+
+// checkFronting reports whether the proxy tunnels to f.connect and the
+// handshake with SNI f.sni verifies through it, followed by a 2xx/3xx
+// answer for f.httpHost when one is configured. Certificates are checked
+// against -ca-bundle if given, otherwise the system roots.
+func (v *validator) checkFronting(proxyAddr string, f *frontCheck) bool {
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", f.connect, f.connect)
+
+	r := bufio.NewReaderSize(conn, 4096)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "HTTP/1.1 200") && !strings.HasPrefix(line, "HTTP/1.0 200") {
+		return false
+	}
+	if !drainHead(r) {
+		return false
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if v.tlsBase != nil {
+		cfg = v.tlsBase.Clone()
+	}
+	cfg.ServerName = f.sni
+	if v.connectTLS != nil {
+		cfg.RootCAs = v.connectTLS.RootCAs
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return false
+	}
+	if f.httpHost == "" {
+		return true
+	}
+
+	fmt.Fprintf(tc, "GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: proxy-scraper/1.0\r\nConnection: close\r\n\r\n", f.httpHost)
+	line, err = bufio.NewReader(tc).ReadString('\n')
+	return err == nil && okStatus(line)
+}
+
+// cacheHeaders are response headers caches use to report a hit.
+var cacheHeaders = []string{"X-Cache", "X-Cache-Status", "CF-Cache-Status", "X-Proxy-Cache"}
+
+// checkCaching sends the probe request with a unique cache-busting query
+// parameter and reports whether the proxy answered from a cache. A response
+// body that echoes the parameter proves the request was forwarded; failing
+// that, a nonzero Age or a HIT in a cache status header gives the cache
+// away, since nothing can legitimately have cached a URL nobody requested
+// before. ok is false if the request itself failed.
+func (v *validator) checkCaching(proxyAddr string) (caching, ok bool) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return false, false
+	}
+	nonce := hex.EncodeToString(b[:])
+	u := *v.probe.URL
+	q := u.Query()
+	q.Set("_pscb", nonce)
+	u.RawQuery = q.Encode()
+
+	conn, err := v.dial(proxyAddr)
+	if err != nil {
+		return false, false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(v.rwTimeout))
+
+	if _, err := conn.Write(v.probe.render(u.String(), "close")); err != nil {
+		return false, false
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return false, false
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if strings.Contains(string(body), nonce) {
+		return false, true
+	}
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		return true, true
+	}
+	for _, h := range cacheHeaders {
+		if strings.Contains(strings.ToUpper(resp.Header.Get(h)), "HIT") {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// tlsVersionNames maps TLS protocol versions to short labels.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "tls1.0",
+	tls.VersionTLS11: "tls1.1",
+	tls.VersionTLS12: "tls1.2",
+	tls.VersionTLS13: "tls1.3",
+}
+
+// tlsFingerprint summarises the server side of a handshake JA3S-style as
+// version/cipher suite, plus the ALPN protocol when one was negotiated.
+// Proxies that intercept TLS tend to stand out because their terminating
+// stack negotiates differently from the real test host.
+func tlsFingerprint(cs *tls.ConnectionState) string {
+	ver, ok := tlsVersionNames[cs.Version]
+	if !ok {
+		ver = fmt.Sprintf("0x%04x", cs.Version)
+	}
+	fp := ver + "/" + tls.CipherSuiteName(cs.CipherSuite)
+	if cs.NegotiatedProtocol != "" {
+		fp += "/" + cs.NegotiatedProtocol
+	}
+	return fp
+}
+
+// tlsVersions maps -tls-min values to their protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the client config that source fetches and every TLS
+// validation check start from: minVersion is the -tls-min value and
+// insecure skips certificate verification.
+func newTLSConfig(minVersion string, insecure bool) (*tls.Config, error) {
+	version, ok := tlsVersions[strings.TrimSpace(minVersion)]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", minVersion)
+	}
+	return &tls.Config{MinVersion: version, InsecureSkipVerify: insecure}, nil
+}
+
+// loadCABundle reads a PEM bundle into a certificate pool.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// checkLargeResponse fetches rawURL through the proxy and reports whether the
+// whole body arrived. At most maxBytes are read; a body larger than that only
+// has to deliver maxBytes. Responses without a Content-Length can't be judged
+// and are accepted. The check is cut short when ctx ends.
+func checkLargeResponse(ctx context.Context, proxyAddr, rawURL string, maxBytes int64, dialTimeout, timeout time.Duration) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	conn, err := dialPostCheck(ctx, "tcp", proxyAddr, dialTimeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	fmt.Fprintf(conn,
+		"GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: proxy-scraper/1.0\r\nConnection: close\r\n\r\n",
+		rawURL, u.Host,
+	)
+
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 32*1024), nil)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	want := resp.ContentLength
+	if want < 0 {
+		return true
+	}
+	if want > maxBytes {
+		want = maxBytes
+	}
+	n, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, want))
+	return n == want
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProxy answers each request read from conn with the response respond
+// picks for its request line, and records the request lines it saw.
+func fakeProxy(conn net.Conn, respond func(requestLine string) string) <-chan []string {
+	seen := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		var lines []string
+		defer func() { seen <- lines }()
+		br := bufio.NewReader(conn)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			for {
+				h, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimSpace(h) == "" {
+					break
+				}
+			}
+			line = strings.TrimSpace(line)
+			lines = append(lines, line)
+			if _, err := conn.Write([]byte(respond(line))); err != nil {
+				return
+			}
+		}
+	}()
+	return seen
+}
+
+func TestProbeHTTPRequestForms(t *testing.T) {
+	const (
+		ok       = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+		rejected = "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"
+	)
+	tests := []struct {
+		name       string
+		originForm bool
+		absolute   string // response to the absolute-form request
+		origin     string // response to the origin-form request
+		want       bool
+		wantTag    bool
+		wantLines  []string
+	}{
+		{
+			name:      "absolute-form accepted",
+			absolute:  ok,
+			want:      true,
+			wantLines: []string{"GET http://example.com/ HTTP/1.1"},
+		},
+		{
+			name:      "absolute-form rejected without fallback",
+			absolute:  rejected,
+			wantLines: []string{"GET http://example.com/ HTTP/1.1"},
+		},
+		{
+			name:       "origin-form fallback",
+			originForm: true,
+			absolute:   rejected,
+			origin:     ok,
+			want:       true,
+			wantTag:    true,
+			wantLines:  []string{"GET http://example.com/ HTTP/1.1", "GET / HTTP/1.1"},
+		},
+		{
+			name:       "both forms rejected",
+			originForm: true,
+			absolute:   rejected,
+			origin:     rejected,
+			wantLines:  []string{"GET http://example.com/ HTTP/1.1", "GET / HTTP/1.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			seen := fakeProxy(server, func(line string) string {
+				if strings.HasPrefix(line, "GET http://") {
+					return tt.absolute
+				}
+				return tt.origin
+			})
+			v := &validator{
+				rwTimeout:  time.Second,
+				probe:      defaultProbeRequest("example.com"),
+				originForm: tt.originForm,
+			}
+			// A reusing session with a connection already open carries
+			// both attempts over the pipe instead of dialling.
+			s := v.newSession("pipe", true)
+			s.conn, s.br = client, bufio.NewReader(client)
+
+			var r result
+			got := v.probeHTTP(s, &r)
+			s.close()
+			client.Close()
+			if got != tt.want {
+				t.Errorf("probeHTTP = %v, want %v", got, tt.want)
+			}
+			tagged := len(r.Tags) == 1 && r.Tags[0] == "origin-form"
+			if tagged != tt.wantTag {
+				t.Errorf("tags = %q, want origin-form tag %v", r.Tags, tt.wantTag)
+			}
+			lines := <-seen
+			if strings.Join(lines, "\n") != strings.Join(tt.wantLines, "\n") {
+				t.Errorf("proxy saw %q, want %q", lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestBodyOKEmptyBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		minBody int64
+		rest    string // everything after the status line
+		want    bool
+	}{
+		{"check off, empty body", 0, "Content-Length: 0\r\n\r\n", true},
+		{"empty body by length", 1, "Content-Length: 0\r\n\r\n", false},
+		{"empty body, connection closed", 1, "\r\n", false},
+		{"empty chunked body", 1, "Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+		{"headers cut short", 1, "Content-Type: text/html\r\n", false},
+		{"short body", 16, "Content-Length: 5\r\n\r\nhello", false},
+		{"body long enough", 5, "Content-Length: 5\r\n\r\nhello", true},
+		{"length header lies", 5, "Content-Length: 5\r\n\r\nhi", false},
+		{"body without length", 5, "\r\nhello world", true},
+		{"chunked body", 5, "Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", true},
+	}
+	for _, tt := range tests {
+		v := &validator{minBody: tt.minBody}
+		if got := v.bodyOK(bufio.NewReader(strings.NewReader(tt.rest))); got != tt.want {
+			t.Errorf("%s: bodyOK = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbeBothSequentialWithinHeadStart(t *testing.T) {
+	const (
+		rejected    = "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: keep-alive\r\n\r\n"
+		established = "HTTP/1.1 200 Connection established\r\n\r\n"
+	)
+	client, server := net.Pipe()
+	seen := fakeProxy(server, func(line string) string {
+		if strings.HasPrefix(line, "CONNECT ") {
+			return established
+		}
+		return rejected
+	})
+	v := &validator{
+		rwTimeout: time.Second,
+		testHost:  "example.com",
+		probe:     defaultProbeRequest("example.com"),
+	}
+	// The session holds the only connection, so a CONNECT probe started
+	// on a second one would fail to dial and the proxy would never see it.
+	s := v.newSession("pipe", true)
+	s.conn, s.br = client, bufio.NewReader(client)
+
+	var r result
+	ok := v.probeBoth(s, &r)
+	s.close()
+	client.Close()
+	if !ok || r.Protocol != "connect" {
+		t.Errorf("probeBoth = %v with protocol %q, want true, connect", ok, r.Protocol)
+	}
+	want := []string{"GET http://example.com/ HTTP/1.1", "CONNECT example.com:443 HTTP/1.1"}
+	if lines := <-seen; strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("proxy saw %q, want %q", lines, want)
+	}
+}
+
+func TestProbeBothConnectCancelsHTTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// The forwarded GET never gets an answer.
+			fakeProxy(conn, func(line string) string {
+				if strings.HasPrefix(line, "CONNECT ") {
+					return "HTTP/1.1 200 Connection established\r\n\r\n"
+				}
+				return ""
+			})
+		}
+	}()
+	v := &validator{
+		dialTimeout: time.Second,
+		rwTimeout:   10 * time.Second,
+		testHost:    "example.com",
+		probe:       defaultProbeRequest("example.com"),
+	}
+	s := v.newSession(ln.Addr().String(), true)
+	var r result
+	start := time.Now()
+	ok := v.probeBoth(s, &r)
+	s.close()
+	if !ok || r.Protocol != "connect" {
+		t.Errorf("probeBoth = %v with protocol %q, want true, connect", ok, r.Protocol)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("probeBoth took %v, want it to stop waiting for HTTP once CONNECT succeeds", d)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// validationCache stores complete validation results keyed by a hash of the
+// deduplicated candidate set and the validation settings, so a re-run over
+// identical inputs can skip validation entirely.
+type validationCache struct {
+	dir         string
+	fingerprint string
+
+	// Set by lookup.
+	key string
+	hit bool
+}
+
+// verdictFlags are the flags outside the validator's own settings (see
+// validator.fingerprint) that change which proxies pass or what their
+// results record. The validation cache is keyed on their values too, so a
+// change to any of them misses instead of replaying stale verdicts.
+var verdictFlags = []string{
+	"dial-timeout", "rw-timeout", "timeout-backoff", "timeout-attempts", "dns",
+	"max-latency", "require-full",
+	"large-url", "large-max-bytes", "large-timeout", "drop-unreliable",
+	"front-connect", "front-sni", "front-http-host",
+	"header-echo-url", "header-test",
+	"anonymity", "anonymity-judge",
+	"cache-bust", "drop-caching",
+	"socks5-udp", "udp-resolver", "dns-leak-zone", "dns-leak-api",
+}
+
+// flagFingerprint renders the current values of the named flags.
+func flagFingerprint(names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		if f := flag.Lookup(name); f != nil {
+			fmt.Fprintf(&b, "%s=%s\n", name, f.Value)
+		}
+	}
+	return b.String()
+}
+
+// lookup computes the key for cands and returns the cached results for it,
+// if any. Each candidate's protocol hint and credential scope are part of
+// the key, since they decide how it is probed.
+func (c *validationCache) lookup(cands []candidate) ([]result, bool) {
+	addrs := make([]string, len(cands))
+	for i, cand := range cands {
+		addrs[i] = cand.Addr + "|" + cand.Protocol + "|" + strconv.FormatBool(cand.Auth)
+	}
+	sort.Strings(addrs)
+
+	h := sha256.New()
+	h.Write([]byte(c.fingerprint))
+	for _, a := range addrs {
+		h.Write([]byte{'\n'})
+		h.Write([]byte(a))
+	}
+	c.key = hex.EncodeToString(h.Sum(nil))
+
+	b, err := os.ReadFile(c.path())
+	if err != nil {
+		return nil, false
+	}
+	var res []result
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, false
+	}
+	c.hit = true
+	return res, true
+}
+
+// store saves results under the key computed by lookup.
+func (c *validationCache) store(results map[string]result) error {
+	res := make([]result, 0, len(results))
+	for _, r := range results {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Proxy < res[j].Proxy })
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	return replaceFile(c.path(), b)
+}
+
+func (c *validationCache) path() string {
+	return filepath.Join(c.dir, c.key+".json")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// sourceWeights returns the weight of every source given one in the
+// sources file (name@3=URL), or nil when all of them have the default
+// weight 1 and candidates are validated in arrival order.
+func sourceWeights(sources []Source) map[string]int {
+	var weights map[string]int
+	for _, src := range sources {
+		if src.Weight > 1 {
+			if weights == nil {
+				weights = make(map[string]int)
+			}
+			weights[src.Name] = src.Weight
+		}
+	}
+	return weights
+}
+
+// weightedQueue holds deduplicated candidates back from validation and
+// releases them interleaved by source weight, using smooth weighted
+// round-robin over the sources with candidates waiting: while both have
+// some, a source of weight 3 gets three candidates validated for every one
+// from a source of weight 1. Within a source, candidates keep their
+// arrival order. Sources without a weight, including stdin and -cache,
+// weigh 1.
+type weightedQueue struct {
+	weights map[string]int
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[string][]candidate
+	current map[string]int
+	// order lists sources by first arrival, so ties go to the earlier one.
+	order  []string
+	n      int
+	closed bool
+}
+
+func newWeightedQueue(weights map[string]int) *weightedQueue {
+	q := &weightedQueue{
+		weights: weights,
+		pending: make(map[string][]candidate),
+		current: make(map[string]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *weightedQueue) weight(source string) int {
+	if w, ok := q.weights[source]; ok {
+		return w
+	}
+	return 1
+}
+
+// push queues c behind the other candidates from its source.
+func (q *weightedQueue) push(c candidate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[c.Source]; !ok {
+		q.order = append(q.order, c.Source)
+	}
+	q.pending[c.Source] = append(q.pending[c.Source], c)
+	q.n++
+	q.cond.Signal()
+}
+
+// close marks the end of input; next drains what is left, then reports
+// false.
+func (q *weightedQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// len returns the number of candidates waiting; a nil queue has none.
+func (q *weightedQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// next waits for a candidate and returns the one the weights pick. It
+// reports false once the queue is closed and empty.
+func (q *weightedQueue) next() (candidate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == 0 {
+		if q.closed {
+			return candidate{}, false
+		}
+		q.cond.Wait()
+	}
+	best, total := "", 0
+	for _, src := range q.order {
+		if len(q.pending[src]) == 0 {
+			continue
+		}
+		w := q.weight(src)
+		q.current[src] += w
+		total += w
+		if best == "" || q.current[src] > q.current[best] {
+			best = src
+		}
+	}
+	q.current[best] -= total
+	c := q.pending[best][0]
+	q.pending[best] = q.pending[best][1:]
+	q.n--
+	return c, true
+}
+
+// drain sends candidates to jobs as validation workers take them, until
+// the queue is closed and empty or ctx ends. The returned channel is
+// closed when it stops.
+func (q *weightedQueue) drain(ctx context.Context, jobs chan<- candidate) <-chan struct{} {
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, q.close)
+	go func() {
+		defer close(done)
+		defer stop()
+		for {
+			c, ok := q.next()
+			if !ok || ctx.Err() != nil {
+				return
+			}
+			select {
+			case jobs <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// weightedOrder returns cands reordered the way a weightedQueue releases
+// them.
+func weightedOrder(cands []candidate, weights map[string]int) []candidate {
+	q := newWeightedQueue(weights)
+	for _, c := range cands {
+		q.push(c)
+	}
+	q.close()
+	out := make([]candidate, 0, len(cands))
+	for {
+		c, ok := q.next()
+		if !ok {
+			return out
+		}
+		out = append(out, c)
+	}
+}